@@ -0,0 +1,130 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"test/client"
+)
+
+const configEnv = "AUTOTESTCTL_CONFIG"
+
+// 一个节点上agent的连接信息
+type AgentConfig struct {
+	Url       string `json:"url"` //http(s)://IP:Port
+	AccessKey string `json:"access_key"`
+	SecretKey string `json:"secret_key"`
+	Sign      bool   `json:"sign"`
+	//https时校验agent证书的CA,以及mtls时的客户端证书
+	CA   string `json:"ca,omitempty"`
+	Cert string `json:"cert,omitempty"`
+	Key  string `json:"key,omitempty"`
+}
+
+type Config struct {
+	Default string                 `json:"default"`
+	Agents  map[string]AgentConfig `json:"agents"`
+}
+
+func defaultConfigPath() string {
+	if path := os.Getenv(configEnv); len(path) != 0 {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ".autotestctl.json"
+	}
+	return filepath.Join(home, ".autotestctl.json")
+}
+
+func loadConfig(path string) (*Config, error) {
+	byteContent, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg := new(Config)
+	if err := json.Unmarshal(byteContent, cfg); err != nil {
+		return nil, fmt.Errorf("parse %s fail: %v", path, err)
+	}
+	return cfg, nil
+}
+
+func (cfg *Config) names() []string {
+	names := make([]string, 0, len(cfg.Agents))
+	for name := range cfg.Agents {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// name为空时用default,只配置了一个agent时用它
+func (cfg *Config) agent(name string) (string, AgentConfig, error) {
+	if len(name) == 0 {
+		name = cfg.Default
+	}
+	if len(name) == 0 && len(cfg.Agents) == 1 {
+		name = cfg.names()[0]
+	}
+	if len(name) == 0 {
+		return "", AgentConfig{}, fmt.Errorf("no agent given and no default in config, use -agent")
+	}
+	agent, ok := cfg.Agents[name]
+	if !ok {
+		return "", AgentConfig{}, fmt.Errorf("agent %s not found in config", name)
+	}
+	if len(agent.Url) == 0 {
+		return "", AgentConfig{}, fmt.Errorf("agent %s has no url", name)
+	}
+	return name, agent, nil
+}
+
+func (agent AgentConfig) transport() (http.RoundTripper, error) {
+	if len(agent.CA) == 0 && len(agent.Cert) == 0 {
+		return nil, nil
+	}
+	cfg := new(tls.Config)
+	if len(agent.CA) != 0 {
+		pem, err := ioutil.ReadFile(agent.CA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", agent.CA)
+		}
+		cfg.RootCAs = pool
+	}
+	if len(agent.Cert) != 0 {
+		cert, err := tls.LoadX509KeyPair(agent.Cert, agent.Key)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: cfg}, nil
+}
+
+// longTimeout用于拉取、推送等耗时的操作,这些操作不会自动重试
+func (agent AgentConfig) client(longTimeout time.Duration) (*client.Client, error) {
+	transport, err := agent.transport()
+	if err != nil {
+		return nil, err
+	}
+	return client.New(client.Options{
+		Url:         agent.Url,
+		AccessKey:   agent.AccessKey,
+		SecretKey:   agent.SecretKey,
+		Sign:        agent.Sign,
+		LongTimeout: longTimeout,
+		Transport:   transport,
+	}), nil
+}
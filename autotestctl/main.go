@@ -0,0 +1,700 @@
+// autotestctl 通过agent接口(/v1)管理节点上的镜像和测试运行
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"test/client"
+	"test/errjson"
+)
+
+const (
+	exitError  = 1
+	exitUsage  = 2
+	exitFailed = 3 //run结束但没有成功
+
+	pollInterval = 2 * time.Second
+)
+
+var (
+	configPath  string
+	agentName   string
+	output      string
+	longTimeout time.Duration
+)
+
+type command struct {
+	usage string
+	help  string
+	run   func(ctx context.Context, c *client.Client, args []string) error
+}
+
+// 子命令的flag用法里要引用commands,放在init里赋值避免初始化循环
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"health":   {"", "check the agent is reachable", cmdHealth},
+		"list":     {"", "list local images", cmdList},
+		"exists":   {"IMAGE:TAG", "check whether an image exists locally", cmdExists},
+		"pull":     {"[-digest D] IMAGE:TAG", "pull an image from the configured registries", cmdPull},
+		"download": {"[-digest D] IMAGE:TAG", "pull an image from the registry in its name", cmdDownload},
+		"push":     {"IMAGE:TAG", "push an image to the configured registry", cmdPush},
+		"tag":      {"OLD NEW", "tag an image, both are IMAGE:TAG", cmdTag},
+		"login":    {"-u USER -p PASSWORD [-server S]", "set registry credentials on the agent", cmdLogin},
+		"run":      {"[flags] IMAGE:TAG [CMD...]", "start a run", cmdRun},
+		"runs":     {"", "list runs", cmdRuns},
+		"get":      {"RUN", "show a run and its attempts", cmdGet},
+		"follow":   {"[-logs] RUN", "wait for a run to finish, printing state changes", cmdFollow},
+		"logs":     {"[-attempt N] [-f] RUN", "print the log of an attempt, the latest by default", cmdLogs},
+		"queue":    {"", "show the run queue", cmdQueue},
+		"drain":    {"", "stop accepting new runs", cmdDrain},
+		"undrain":  {"", "accept new runs again", cmdUndrain},
+		"shutdown": {"[-timeout D]", "drain and stop the agent", cmdShutdown},
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: autotestctl [-config FILE] [-agent NAME] [-o text|json] [-long-timeout D] COMMAND [ARGS]\n\n")
+	fmt.Fprintf(os.Stderr, "commands:\n")
+	w := tabwriter.NewWriter(os.Stderr, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "  agents\t\tlist agents in the config file\n")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "  %s\t%s\t%s\n", name, commands[name].usage, commands[name].help)
+	}
+	w.Flush()
+	fmt.Fprintf(os.Stderr, "\nflags:\n")
+	flag.PrintDefaults()
+}
+
+func main() {
+	flag.StringVar(&configPath, "config", defaultConfigPath(), "config file listing agents, also $"+configEnv)
+	flag.StringVar(&agentName, "agent", "", "agent name in the config file, default is the config's default")
+	flag.StringVar(&output, "o", "text", "output format: text or json")
+	flag.DurationVar(&longTimeout, "long-timeout", 0, "time limit for pull, push, download, logs and artifacts, 0 means no limit")
+	flag.Usage = usage
+	flag.Parse()
+
+	if output != "text" && output != "json" {
+		fmt.Fprintf(os.Stderr, "invalid output format %q\n", output)
+		os.Exit(exitUsage)
+	}
+	args := flag.Args()
+	if len(args) == 0 {
+		usage()
+		os.Exit(exitUsage)
+	}
+
+	cfg, err := loadConfig(configPath)
+	if err != nil {
+		fail(err)
+	}
+	if args[0] == "agents" {
+		listAgents(cfg)
+		return
+	}
+	cmd, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", args[0])
+		usage()
+		os.Exit(exitUsage)
+	}
+	_, agent, err := cfg.agent(agentName)
+	if err != nil {
+		fail(err)
+	}
+	c, err := agent.client(longTimeout)
+	if err != nil {
+		fail(err)
+	}
+
+	//Ctrl-C时取消正在进行的请求
+	ctx, cancel := context.WithCancel(context.Background())
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		cancel()
+	}()
+
+	if err := cmd.run(ctx, c, args[1:]); err != nil {
+		fail(err)
+	}
+}
+
+type exitCode int
+
+func (code exitCode) Error() string {
+	return fmt.Sprintf("exit %d", int(code))
+}
+
+func fail(err error) {
+	if code, ok := err.(exitCode); ok {
+		os.Exit(int(code))
+	}
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(exitUsage)
+	}
+	if output == "json" {
+		var e errjson.RespError
+		switch cause := client.Cause(err).(type) {
+		case errjson.Responder:
+			e = cause.Response()
+		default:
+			e = errjson.RespError{Type: "error", Status: 0, Code: "error", Data: err.Error()}
+		}
+		resp := map[string]interface{}{"error": e}
+		if ce, ok := err.(*client.Error); ok && len(ce.RequestID) != 0 {
+			resp["request_id"] = ce.RequestID
+		}
+		byteContent, _ := json.MarshalIndent(resp, "", "  ")
+		fmt.Fprintln(os.Stderr, string(byteContent))
+	} else {
+		fmt.Fprintln(os.Stderr, "error:", err)
+	}
+	os.Exit(exitError)
+}
+
+// json时输出v,text时调用text
+func show(v interface{}, text func(w io.Writer)) {
+	if output == "json" {
+		byteContent, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			fail(err)
+		}
+		fmt.Println(string(byteContent))
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	text(w)
+	w.Flush()
+}
+
+func done(action string) {
+	show(map[string]bool{"ok": true}, func(w io.Writer) {
+		fmt.Fprintln(w, action)
+	})
+}
+
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+func newFlags(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: autotestctl %s %s\n", name, commands[name].usage)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+func wantArgs(fs *flag.FlagSet, n int) error {
+	if fs.NArg() != n {
+		fs.Usage()
+		return exitCode(exitUsage)
+	}
+	return nil
+}
+
+// tag从最后一个"/"之后的":"分开,没有tag时用latest
+func splitImage(ref string) (string, string) {
+	i := strings.LastIndex(ref, ":")
+	if i < 0 || strings.Contains(ref[i:], "/") {
+		return ref, "latest"
+	}
+	return ref[:i], ref[i+1:]
+}
+
+func listAgents(cfg *Config) {
+	type agentInfo struct {
+		Name    string `json:"name"`
+		Url     string `json:"url"`
+		Default bool   `json:"default"`
+	}
+	agents := []agentInfo{}
+	for _, name := range cfg.names() {
+		agents = append(agents, agentInfo{Name: name, Url: cfg.Agents[name].Url, Default: name == cfg.Default})
+	}
+	show(agents, func(w io.Writer) {
+		fmt.Fprintln(w, "NAME\tURL\tDEFAULT")
+		for _, a := range agents {
+			def := ""
+			if a.Default {
+				def = "*"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\n", a.Name, a.Url, def)
+		}
+	})
+}
+
+func cmdHealth(ctx context.Context, c *client.Client, args []string) error {
+	fs := newFlags("health")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := wantArgs(fs, 0); err != nil {
+		return err
+	}
+	if err := c.Health(ctx); err != nil {
+		return err
+	}
+	done("ok")
+	return nil
+}
+
+func cmdList(ctx context.Context, c *client.Client, args []string) error {
+	fs := newFlags("list")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := wantArgs(fs, 0); err != nil {
+		return err
+	}
+	images, err := c.ListImages(ctx)
+	if err != nil {
+		return err
+	}
+	show(images, func(w io.Writer) {
+		fmt.Fprintln(w, "IMAGE")
+		for _, image := range images {
+			fmt.Fprintln(w, image.Image)
+		}
+	})
+	return nil
+}
+
+func cmdExists(ctx context.Context, c *client.Client, args []string) error {
+	fs := newFlags("exists")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := wantArgs(fs, 1); err != nil {
+		return err
+	}
+	image, tag := splitImage(fs.Arg(0))
+	exists, err := c.Exists(ctx, image, tag)
+	if err != nil {
+		return err
+	}
+	show(client.ImageExists{Image: image + ":" + tag, Exists: exists}, func(w io.Writer) {
+		fmt.Fprintln(w, exists)
+	})
+	return nil
+}
+
+func pullWith(name string, pull func(ctx context.Context, image, tag, digest string) error) func(context.Context, *client.Client, []string) error {
+	return func(ctx context.Context, c *client.Client, args []string) error {
+		fs := newFlags(name)
+		digest := fs.String("digest", "", "expected digest (sha256:...), the pulled image is removed on mismatch")
+		if err := fs.Parse(args); err != nil {
+			return err
+		}
+		if err := wantArgs(fs, 1); err != nil {
+			return err
+		}
+		image, tag := splitImage(fs.Arg(0))
+		if err := pull(ctx, image, tag, *digest); err != nil {
+			return err
+		}
+		done("pulled " + image + ":" + tag)
+		return nil
+	}
+}
+
+func cmdPull(ctx context.Context, c *client.Client, args []string) error {
+	return pullWith("pull", c.Pull)(ctx, c, args)
+}
+
+func cmdDownload(ctx context.Context, c *client.Client, args []string) error {
+	return pullWith("download", c.Download)(ctx, c, args)
+}
+
+func cmdPush(ctx context.Context, c *client.Client, args []string) error {
+	fs := newFlags("push")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := wantArgs(fs, 1); err != nil {
+		return err
+	}
+	image, tag := splitImage(fs.Arg(0))
+	if err := c.Push(ctx, image, tag); err != nil {
+		return err
+	}
+	done("pushed " + image + ":" + tag)
+	return nil
+}
+
+func cmdTag(ctx context.Context, c *client.Client, args []string) error {
+	fs := newFlags("tag")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := wantArgs(fs, 2); err != nil {
+		return err
+	}
+	if err := c.Tag(ctx, fs.Arg(0), fs.Arg(1)); err != nil {
+		return err
+	}
+	done("tagged " + fs.Arg(0) + " as " + fs.Arg(1))
+	return nil
+}
+
+func cmdLogin(ctx context.Context, c *client.Client, args []string) error {
+	fs := newFlags("login")
+	var info client.UserInfo
+	fs.StringVar(&info.User, "u", "", "registry user")
+	fs.StringVar(&info.Password, "p", "", "registry password, read from stdin when -")
+	fs.StringVar(&info.Server, "server", "", "registry address, empty for docker hub")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := wantArgs(fs, 0); err != nil {
+		return err
+	}
+	if info.Password == "-" {
+		byteContent, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			return err
+		}
+		info.Password = strings.TrimRight(string(byteContent), "\r\n")
+	}
+	if len(info.User) == 0 || len(info.Password) == 0 {
+		fs.Usage()
+		return exitCode(exitUsage)
+	}
+	if err := c.Login(ctx, info); err != nil {
+		return err
+	}
+	done("login succeeded")
+	return nil
+}
+
+func printRuns(runs []client.Run) {
+	show(runs, func(w io.Writer) {
+		fmt.Fprintln(w, "ID\tIMAGE\tPROJECT\tSTATE\tATTEMPTS\tCREATED")
+		for _, run := range runs {
+			fmt.Fprintf(w, "%s\t%s:%s\t%s\t%s\t%d\t%s\n", run.ID, run.Spec.Image, run.Spec.Tag,
+				run.Spec.Project, run.State, len(run.Attempts), run.Created.Local().Format(time.RFC3339))
+		}
+	})
+}
+
+func printRun(run *client.Run) {
+	show(run, func(w io.Writer) {
+		fmt.Fprintf(w, "ID:\t%s\n", run.ID)
+		fmt.Fprintf(w, "Image:\t%s:%s\n", run.Spec.Image, run.Spec.Tag)
+		if len(run.Spec.Project) != 0 {
+			fmt.Fprintf(w, "Project:\t%s\n", run.Spec.Project)
+		}
+		fmt.Fprintf(w, "State:\t%s\n", run.State)
+		if len(run.Error) != 0 {
+			fmt.Fprintf(w, "Error:\t%s\n", run.Error)
+		}
+		fmt.Fprintf(w, "Created:\t%s\n", run.Created.Local().Format(time.RFC3339))
+		if len(run.Attempts) == 0 {
+			return
+		}
+		fmt.Fprintln(w, "\nATTEMPT\tCONTAINER\tSTATE\tEXIT\tSTARTED\tFINISHED")
+		for _, job := range run.Attempts {
+			container := job.ContainerID
+			if len(container) > 12 {
+				container = container[:12]
+			}
+			finished := ""
+			if !job.FinishedAt.IsZero() {
+				finished = job.FinishedAt.Local().Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\t%d\t%s\t%s\n", job.Attempt, container, job.State, job.ExitCode,
+				job.StartedAt.Local().Format(time.RFC3339), finished)
+		}
+	})
+}
+
+func cmdRun(ctx context.Context, c *client.Client, args []string) error {
+	fs := newFlags("run")
+	var spec client.RunSpec
+	var env, artifacts stringList
+	fs.StringVar(&spec.Project, "project", "", "project the run belongs to")
+	fs.IntVar(&spec.Priority, "priority", 0, "queue priority, larger runs first")
+	fs.StringVar(&spec.Digest, "digest", "", "expected image digest")
+	fs.Var(&env, "env", "KEY=VALUE, repeatable")
+	fs.Var(&artifacts, "artifact", "path collected from the container after each attempt, repeatable")
+	retries := fs.Int("retries", 0, "max attempts, 0 means no retry")
+	follow := fs.Bool("follow", false, "wait for the run to finish")
+	logs := fs.Bool("logs", false, "with -follow, stream the logs of each attempt")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() < 1 {
+		fs.Usage()
+		return exitCode(exitUsage)
+	}
+	spec.Image, spec.Tag = splitImage(fs.Arg(0))
+	spec.Cmd = fs.Args()[1:]
+	spec.Env = env
+	spec.Artifacts = artifacts
+	if *retries > 0 {
+		spec.Retry = &client.RetryPolicy{MaxAttempts: *retries}
+	}
+
+	run, err := c.CreateRun(ctx, spec)
+	if err != nil {
+		return err
+	}
+	if !*follow {
+		printRun(run)
+		return nil
+	}
+	if output == "text" {
+		fmt.Printf("run %s created\n", run.ID)
+	}
+	return followRun(ctx, c, run.ID, *logs)
+}
+
+func cmdRuns(ctx context.Context, c *client.Client, args []string) error {
+	fs := newFlags("runs")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := wantArgs(fs, 0); err != nil {
+		return err
+	}
+	runs, err := c.ListRuns(ctx)
+	if err != nil {
+		return err
+	}
+	printRuns(runs)
+	return nil
+}
+
+func cmdGet(ctx context.Context, c *client.Client, args []string) error {
+	fs := newFlags("get")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := wantArgs(fs, 1); err != nil {
+		return err
+	}
+	run, err := c.GetRun(ctx, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	printRun(run)
+	return nil
+}
+
+func cmdFollow(ctx context.Context, c *client.Client, args []string) error {
+	fs := newFlags("follow")
+	logs := fs.Bool("logs", false, "stream the logs of each attempt")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := wantArgs(fs, 1); err != nil {
+		return err
+	}
+	return followRun(ctx, c, fs.Arg(0), *logs)
+}
+
+func succeeded(run *client.Run) bool {
+	return run.State == "succeeded" || run.State == "flaky-passed"
+}
+
+// 等run结束;text时逐行打印状态变化,json时只输出最终的run。run没有成功时退出码为3
+func followRun(ctx context.Context, c *client.Client, id string, logs bool) error {
+	var run *client.Run
+	var err error
+	if logs {
+		run, err = streamLogs(ctx, c, id, 1, true)
+	} else {
+		run, err = c.WaitRun(ctx, id, pollInterval, func(run *client.Run) {
+			if output == "text" {
+				fmt.Printf("%s  %s  %s  attempts=%d\n", time.Now().Format("15:04:05"), run.ID, run.State, len(run.Attempts))
+			}
+		})
+	}
+	if err != nil {
+		return err
+	}
+	if output == "json" {
+		printRun(run)
+	} else {
+		fmt.Printf("run %s finished: %s\n", run.ID, run.State)
+	}
+	if !succeeded(run) {
+		return exitCode(exitFailed)
+	}
+	return nil
+}
+
+// 从第attempt次尝试开始输出日志;follow时跟着运行中的容器输出,并接着输出后面重试的尝试,直到run结束
+func streamLogs(ctx context.Context, c *client.Client, id string, attempt int, follow bool) (*client.Run, error) {
+	for {
+		run, err := c.GetRun(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if attempt <= len(run.Attempts) {
+			if len(run.Attempts) > 1 || attempt > 1 {
+				fmt.Fprintf(os.Stderr, "==> %s attempt %d <==\n", id, attempt)
+			}
+			var rc io.ReadCloser
+			if follow {
+				rc, err = c.FollowJobLog(ctx, id, attempt)
+			} else {
+				rc, err = c.JobLog(ctx, id, attempt)
+			}
+			if err == nil {
+				_, err = io.Copy(os.Stdout, rc)
+				rc.Close()
+			}
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			if !follow {
+				return run, err
+			}
+			//容器还没创建时没有日志,稍后再试
+			if _, notFound := client.Cause(err).(errjson.NotFoundError); !notFound && err != nil {
+				return nil, err
+			}
+			if err == nil {
+				attempt++
+				continue
+			}
+		} else if run.Finished() || !follow {
+			return run, nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(pollInterval):
+		}
+	}
+}
+
+func cmdLogs(ctx context.Context, c *client.Client, args []string) error {
+	fs := newFlags("logs")
+	attempt := fs.Int("attempt", 0, "attempt number, 0 means the latest")
+	follow := fs.Bool("f", false, "follow the running container, then any retries, until the run finishes")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := wantArgs(fs, 1); err != nil {
+		return err
+	}
+	id := fs.Arg(0)
+	if *attempt <= 0 {
+		run, err := c.GetRun(ctx, id)
+		if err != nil {
+			return err
+		}
+		if len(run.Attempts) == 0 && !*follow {
+			return fmt.Errorf("run %s has not started yet", id)
+		}
+		*attempt = len(run.Attempts)
+		if *attempt == 0 {
+			*attempt = 1
+		}
+	}
+	_, err := streamLogs(ctx, c, id, *attempt, *follow)
+	return err
+}
+
+func cmdQueue(ctx context.Context, c *client.Client, args []string) error {
+	fs := newFlags("queue")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := wantArgs(fs, 0); err != nil {
+		return err
+	}
+	status, err := c.Queue(ctx)
+	if err != nil {
+		return err
+	}
+	show(status, func(w io.Writer) {
+		fmt.Fprintf(w, "active %d/%d, pending %d\n", status.Active, status.MaxRuns, len(status.Pending))
+		if len(status.Pending) == 0 {
+			return
+		}
+		fmt.Fprintln(w, "\nPOS\tRUN\tPROJECT\tPRIORITY\tQUEUED")
+		for _, item := range status.Pending {
+			fmt.Fprintf(w, "%d\t%s\t%s\t%d\t%s\n", item.Position, item.RunID, item.Project, item.Priority,
+				item.QueuedAt.Local().Format(time.RFC3339))
+		}
+	})
+	return nil
+}
+
+func cmdDrain(ctx context.Context, c *client.Client, args []string) error {
+	fs := newFlags("drain")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := wantArgs(fs, 0); err != nil {
+		return err
+	}
+	if err := c.Drain(ctx); err != nil {
+		return err
+	}
+	done("draining, new runs are rejected")
+	return nil
+}
+
+func cmdUndrain(ctx context.Context, c *client.Client, args []string) error {
+	fs := newFlags("undrain")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := wantArgs(fs, 0); err != nil {
+		return err
+	}
+	if err := c.Undrain(ctx); err != nil {
+		return err
+	}
+	done("accepting runs")
+	return nil
+}
+
+func cmdShutdown(ctx context.Context, c *client.Client, args []string) error {
+	fs := newFlags("shutdown")
+	timeout := fs.Duration("timeout", -1, "max time to wait for in-flight work, negative uses the agent default")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := wantArgs(fs, 0); err != nil {
+		return err
+	}
+	if err := c.Shutdown(ctx, *timeout); err != nil {
+		return err
+	}
+	done("shutting down")
+	return nil
+}
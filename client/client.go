@@ -0,0 +1,442 @@
+// agent接口(/v1)的Go客户端
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"test/errjson"
+)
+
+const (
+	apiPrefix        = "/v1"
+	DefaultTimeout   = 30 * time.Second
+	DefaultRetries   = 3
+	DefaultRetryWait = 500 * time.Millisecond
+)
+
+type Options struct {
+	Url       string //http(s)://IP:Port
+	AccessKey string
+	SecretKey string
+	//用HMAC签名代替basic认证
+	Sign    bool
+	Timeout time.Duration
+	//拉取、推送、下载镜像和读取日志、产物的超时,0表示不限制,只靠ctx取消;这些请求不重试
+	LongTimeout time.Duration
+	Transport   http.RoundTripper
+	//幂等请求(GET/PUT/DELETE)在网络错误或502/503/504时的重试次数
+	Retries   int
+	RetryWait time.Duration
+}
+
+type Client struct {
+	opts Options
+	http *http.Client
+	//耗时的请求不能用整体超时,只靠ctx取消
+	streamHTTP *http.Client
+}
+
+type envelope struct {
+	Data      json.RawMessage    `json:"data"`
+	Error     *errjson.RespError `json:"error"`
+	RequestID string             `json:"request_id"`
+}
+
+// 请求失败时返回的错误,Err是errjson里对应的类型
+type Error struct {
+	Err       error
+	RequestID string
+}
+
+func (e *Error) Error() string {
+	if len(e.RequestID) == 0 {
+		return e.Err.Error()
+	}
+	return e.Err.Error() + " (request " + e.RequestID + ")"
+}
+
+// 可以用类型断言取出errjson的错误类型
+func Cause(err error) error {
+	if e, ok := err.(*Error); ok {
+		return e.Err
+	}
+	return err
+}
+
+func New(opts Options) *Client {
+	if opts.Timeout == 0 {
+		opts.Timeout = DefaultTimeout
+	}
+	if opts.Retries == 0 {
+		opts.Retries = DefaultRetries
+	}
+	if opts.RetryWait == 0 {
+		opts.RetryWait = DefaultRetryWait
+	}
+	opts.Url = strings.TrimRight(opts.Url, "/")
+	return &Client{
+		opts:       opts,
+		http:       &http.Client{Timeout: opts.Timeout, Transport: opts.Transport},
+		streamHTTP: &http.Client{Transport: opts.Transport},
+	}
+}
+
+// 和handler.SignRequest的算法一致
+func sign(secret, method, uri, timestamp, nonce string, body []byte) string {
+	sum := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(method + "\n" + uri + "\n" + timestamp + "\n" + nonce + "\n" + hex.EncodeToString(sum[:])))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func newNonce() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func (c *Client) newRequest(ctx context.Context, method, path string, body []byte) (*http.Request, error) {
+	req, err := http.NewRequest(method, c.opts.Url+apiPrefix+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	//每次重试都会重新调用,时间戳和nonce都是新的
+	if c.opts.Sign {
+		ts := strconv.FormatInt(time.Now().Unix(), 10)
+		nonce, err := newNonce()
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("X-Auth-Key", c.opts.AccessKey)
+		req.Header.Set("X-Auth-Timestamp", ts)
+		req.Header.Set("X-Auth-Nonce", nonce)
+		req.Header.Set("X-Auth-Signature", sign(c.opts.SecretKey, method, req.URL.RequestURI(), ts, nonce, body))
+	} else if len(c.opts.AccessKey) != 0 {
+		req.SetBasicAuth(c.opts.AccessKey, c.opts.SecretKey)
+	}
+	return req, nil
+}
+
+func idempotent(method string) bool {
+	switch method {
+	case "GET", "HEAD", "PUT", "DELETE":
+		return true
+	}
+	return false
+}
+
+func retryable(status int) bool {
+	return status == http.StatusBadGateway || status == http.StatusServiceUnavailable || status == http.StatusGatewayTimeout
+}
+
+// 发送请求,幂等请求失败时按指数退避重试;每次重试都重新签名
+func (c *Client) do(ctx context.Context, method, path string, body []byte) (*http.Response, error) {
+	return c.doWith(c.http, true, ctx, method, path, body)
+}
+
+// retry为false时只发送一次,用于agent那边取消不了的耗时操作,超时后重发只会让操作越积越多
+func (c *Client) doWith(hc *http.Client, retry bool, ctx context.Context, method, path string, body []byte) (*http.Response, error) {
+	attempts := 1
+	if retry && idempotent(method) {
+		attempts += c.opts.Retries
+	}
+	wait := c.opts.RetryWait
+
+	var lastErr error
+	for i := 0; i < attempts; i++ {
+		if i > 0 {
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(wait):
+			}
+			wait *= 2
+		}
+
+		req, err := c.newRequest(ctx, method, path, body)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := hc.Do(req)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			lastErr = err
+			continue
+		}
+		if retryable(resp.StatusCode) && i < attempts-1 {
+			lastErr = decodeError(resp)
+			resp.Body.Close()
+			continue
+		}
+		return resp, nil
+	}
+	return nil, lastErr
+}
+
+func decodeError(resp *http.Response) error {
+	var e envelope
+	byteContent, _ := ioutil.ReadAll(resp.Body)
+	if json.Unmarshal(byteContent, &e) == nil && e.Error != nil {
+		return &Error{Err: errjson.Typed(*e.Error), RequestID: e.RequestID}
+	}
+	return &Error{
+		Err:       errjson.RespError{Type: "error", Status: resp.StatusCode, Code: resp.Status, Data: string(byteContent)},
+		RequestID: resp.Header.Get("X-Request-Id"),
+	}
+}
+
+// 请求并把返回的data解到out里,out为nil时忽略data
+func (c *Client) call(ctx context.Context, method, path string, in interface{}, out interface{}) error {
+	return c.callWith(c.http, true, ctx, method, path, in, out)
+}
+
+// 拉取、推送等耗时的操作,只受LongTimeout和ctx限制,不重试
+func (c *Client) longCall(ctx context.Context, path string) error {
+	ctx, cancel := c.longContext(ctx)
+	defer cancel()
+	return c.callWith(c.streamHTTP, false, ctx, "GET", path, nil, nil)
+}
+
+func (c *Client) longContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if c.opts.LongTimeout > 0 {
+		return context.WithTimeout(ctx, c.opts.LongTimeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+func (c *Client) callWith(hc *http.Client, retry bool, ctx context.Context, method, path string, in interface{}, out interface{}) error {
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return err
+		}
+	}
+	resp, err := c.doWith(hc, retry, ctx, method, path, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return decodeError(resp)
+	}
+
+	var e envelope
+	if err := json.NewDecoder(resp.Body).Decode(&e); err != nil {
+		return fmt.Errorf("decode response of %s %s fail: %v", method, path, err)
+	}
+	if out == nil || len(e.Data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(e.Data, out)
+}
+
+// 日志、产物等直接返回内容的接口,和longCall一样只受LongTimeout和ctx限制
+func (c *Client) stream(ctx context.Context, path string) (io.ReadCloser, error) {
+	ctx, cancel := c.longContext(ctx)
+	body, err := c.streamWith(ctx, path)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return &cancelBody{ReadCloser: body, cancel: cancel}, nil
+}
+
+func (c *Client) streamWith(ctx context.Context, path string) (io.ReadCloser, error) {
+	resp, err := c.doWith(c.streamHTTP, false, ctx, "GET", path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 400 {
+		defer resp.Body.Close()
+		return nil, decodeError(resp)
+	}
+	return resp.Body, nil
+}
+
+// 读完关闭时释放LongTimeout的定时器
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+func imagePath(image, tag string) string {
+	return "/" + image + "/" + url.PathEscape(tag)
+}
+
+func withDigest(path, digest string) string {
+	if len(digest) == 0 {
+		return path
+	}
+	return path + "?digest=" + url.QueryEscape(digest)
+}
+
+func (c *Client) Health(ctx context.Context) error {
+	return c.call(ctx, "GET", "/health", nil, nil)
+}
+
+func (c *Client) ListImages(ctx context.Context) ([]Image, error) {
+	var images []Image
+	err := c.call(ctx, "GET", "/list", nil, &images)
+	return images, err
+}
+
+func (c *Client) Exists(ctx context.Context, image, tag string) (bool, error) {
+	var result ImageExists
+	err := c.call(ctx, "GET", "/exists"+imagePath(image, tag), nil, &result)
+	return result.Exists, err
+}
+
+// 从配置的仓库拉取;digest不为空时拉取后校验
+func (c *Client) Pull(ctx context.Context, image, tag, digest string) error {
+	return c.longCall(ctx, withDigest("/pull"+imagePath(image, tag), digest))
+}
+
+// 从镜像名里的仓库直接拉取
+func (c *Client) Download(ctx context.Context, image, tag, digest string) error {
+	return c.longCall(ctx, withDigest("/download"+imagePath(image, tag), digest))
+}
+
+func (c *Client) Push(ctx context.Context, image, tag string) error {
+	return c.longCall(ctx, "/push"+imagePath(image, tag))
+}
+
+// old/new都是image:tag
+func (c *Client) Tag(ctx context.Context, old, new string) error {
+	return c.call(ctx, "POST", "/tag", map[string]string{"old": old, "new": new}, nil)
+}
+
+func (c *Client) Login(ctx context.Context, info UserInfo) error {
+	return c.call(ctx, "POST", "/login", info, nil)
+}
+
+func (c *Client) CreateRun(ctx context.Context, spec RunSpec) (*Run, error) {
+	run := new(Run)
+	if err := c.call(ctx, "POST", "/runs", spec, run); err != nil {
+		return nil, err
+	}
+	return run, nil
+}
+
+func (c *Client) ListRuns(ctx context.Context) ([]Run, error) {
+	var runs []Run
+	err := c.call(ctx, "GET", "/runs", nil, &runs)
+	return runs, err
+}
+
+func (c *Client) GetRun(ctx context.Context, id string) (*Run, error) {
+	run := new(Run)
+	if err := c.call(ctx, "GET", "/runs/"+url.PathEscape(id), nil, run); err != nil {
+		return nil, err
+	}
+	return run, nil
+}
+
+// run的所有尝试(job)
+func (c *Client) Jobs(ctx context.Context, runID string) ([]*Job, error) {
+	run, err := c.GetRun(ctx, runID)
+	if err != nil {
+		return nil, err
+	}
+	return run.Attempts, nil
+}
+
+// 轮询直到run结束,每次状态变化调用onChange(可以为nil)
+func (c *Client) WaitRun(ctx context.Context, id string, interval time.Duration, onChange func(*Run)) (*Run, error) {
+	state := ""
+	for {
+		run, err := c.GetRun(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if run.State != state {
+			state = run.State
+			if onChange != nil {
+				onChange(run)
+			}
+		}
+		if run.Finished() {
+			return run, nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+}
+
+func (c *Client) JobLog(ctx context.Context, runID string, attempt int) (io.ReadCloser, error) {
+	return c.stream(ctx, fmt.Sprintf("/runs/%s/attempts/%d/log", url.PathEscape(runID), attempt))
+}
+
+// 尝试还在运行时持续输出容器日志,直到容器退出或ctx取消;已结束的尝试返回保存的日志
+func (c *Client) FollowJobLog(ctx context.Context, runID string, attempt int) (io.ReadCloser, error) {
+	return c.streamWith(ctx, fmt.Sprintf("/runs/%s/attempts/%d/log?follow=true", url.PathEscape(runID), attempt))
+}
+
+// tar格式
+func (c *Client) JobArtifact(ctx context.Context, runID string, attempt int, name string) (io.ReadCloser, error) {
+	return c.stream(ctx, fmt.Sprintf("/runs/%s/attempts/%d/artifacts/%s", url.PathEscape(runID), attempt, url.PathEscape(name)))
+}
+
+func (c *Client) Queue(ctx context.Context) (*QueueStatus, error) {
+	status := new(QueueStatus)
+	if err := c.call(ctx, "GET", "/queue", nil, status); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+func (c *Client) Reprioritize(ctx context.Context, runID string, priority int) error {
+	return c.call(ctx, "PUT", "/queue/"+url.PathEscape(runID), map[string]int{"priority": priority}, nil)
+}
+
+func (c *Client) Dequeue(ctx context.Context, runID string) error {
+	return c.call(ctx, "DELETE", "/queue/"+url.PathEscape(runID), nil, nil)
+}
+
+func (c *Client) Drain(ctx context.Context) error {
+	return c.call(ctx, "POST", "/drain", nil, nil)
+}
+
+func (c *Client) Undrain(ctx context.Context) error {
+	return c.call(ctx, "POST", "/undrain", nil, nil)
+}
+
+// 等待工作排空的最长时间,<0 使用agent的默认值
+func (c *Client) Shutdown(ctx context.Context, timeout time.Duration) error {
+	path := "/shutdown"
+	if timeout >= 0 {
+		path += "?timeout=" + strconv.Itoa(int(timeout/time.Second))
+	}
+	return c.call(ctx, "POST", path, nil, nil)
+}
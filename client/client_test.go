@@ -0,0 +1,94 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"test/handler"
+)
+
+// 拉取等agent取消不了的操作不能重试,其余幂等请求照常重试
+func TestRetries(t *testing.T) {
+	var hits int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+	c := New(Options{Url: srv.URL, RetryWait: time.Millisecond})
+	ctx := context.Background()
+
+	cases := []struct {
+		name string
+		call func() error
+		hits int32
+	}{
+		{"list", func() error { _, err := c.ListImages(ctx); return err }, 1 + DefaultRetries},
+		{"pull", func() error { return c.Pull(ctx, "busybox", "latest", "") }, 1},
+		{"download", func() error { return c.Download(ctx, "busybox", "latest", "") }, 1},
+		{"push", func() error { return c.Push(ctx, "busybox", "latest") }, 1},
+		{"log", func() error { _, err := c.JobLog(ctx, "r", 1); return err }, 1},
+	}
+	for _, tc := range cases {
+		atomic.StoreInt32(&hits, 0)
+		if err := tc.call(); err == nil {
+			t.Errorf("%s: no error", tc.name)
+		}
+		if n := atomic.LoadInt32(&hits); n != tc.hits {
+			t.Errorf("%s: %d request(s), want %d", tc.name, n, tc.hits)
+		}
+	}
+}
+
+// 耗时的操作不受Timeout限制,只受LongTimeout限制
+func TestLongTimeout(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(200 * time.Millisecond):
+		}
+		w.Write([]byte(`{"meta":{}}`))
+	}))
+	defer srv.Close()
+	ctx := context.Background()
+
+	c := New(Options{Url: srv.URL, Timeout: 50 * time.Millisecond})
+	if err := c.Pull(ctx, "busybox", "latest", ""); err != nil {
+		t.Errorf("pull limited by Timeout: %v", err)
+	}
+	c = New(Options{Url: srv.URL, LongTimeout: 50 * time.Millisecond})
+	if err := c.Pull(ctx, "busybox", "latest", ""); err != context.DeadlineExceeded {
+		t.Errorf("pull with LongTimeout: %v", err)
+	}
+}
+
+// 签名请求每次重试都用新的nonce,不会被agent当成重放
+func TestSignedRetries(t *testing.T) {
+	handler.SetAccessKeys([]handler.AccessKey{{AccessKey: "ak", SecretKey: "sk"}})
+	var hits int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := handler.Authenticate(r); err != nil {
+			t.Errorf("attempt %d: %v", atomic.LoadInt32(&hits)+1, err)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if atomic.AddInt32(&hits, 1) <= DefaultRetries {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"data":[],"meta":{}}`))
+	}))
+	defer srv.Close()
+
+	c := New(Options{Url: srv.URL, AccessKey: "ak", SecretKey: "sk", Sign: true, RetryWait: time.Millisecond})
+	for i := 0; i < 2; i++ {
+		atomic.StoreInt32(&hits, 0)
+		if _, err := c.ListImages(context.Background()); err != nil {
+			t.Errorf("round %d: %v", i, err)
+		}
+	}
+}
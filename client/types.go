@@ -0,0 +1,89 @@
+package client
+
+import (
+	"time"
+)
+
+// 和agent接口的JSON一一对应,不引用handler包,避免引入agent的初始化
+
+type Image struct {
+	Image string `json:"image"`
+}
+
+type ImageExists struct {
+	Image  string `json:"image"`
+	Exists bool   `json:"exists"`
+}
+
+type UserInfo struct {
+	User     string `json:"user"`
+	Password string `json:"password"`
+	Server   string `json:"server"`
+}
+
+type RetryPolicy struct {
+	MaxAttempts       int   `json:"max_attempts"`
+	ExitCodes         []int `json:"exit_codes"`
+	BackoffSeconds    int   `json:"backoff_seconds"`
+	MaxBackoffSeconds int   `json:"max_backoff_seconds"`
+}
+
+type RunSpec struct {
+	Image     string       `json:"image"`
+	Tag       string       `json:"tag"`
+	Digest    string       `json:"digest,omitempty"`
+	Cmd       []string     `json:"cmd"`
+	Env       []string     `json:"env"`
+	Project   string       `json:"project"`
+	Priority  int          `json:"priority"`
+	Artifacts []string     `json:"artifacts"`
+	Retry     *RetryPolicy `json:"retry,omitempty"`
+}
+
+// run的一次尝试
+type Job struct {
+	Attempt     int       `json:"attempt"`
+	ContainerID string    `json:"container_id"`
+	State       string    `json:"state"`
+	ExitCode    int       `json:"exit_code"`
+	OOMKilled   bool      `json:"oom_killed"`
+	Killed      bool      `json:"killed"`
+	Removed     bool      `json:"removed"`
+	Error       string    `json:"error,omitempty"`
+	StartedAt   time.Time `json:"started_at"`
+	FinishedAt  time.Time `json:"finished_at"`
+	LogFile     string    `json:"log_file,omitempty"`
+	Artifacts   []string  `json:"artifacts,omitempty"`
+}
+
+type Run struct {
+	ID       string    `json:"id"`
+	Spec     RunSpec   `json:"spec"`
+	State    string    `json:"state"`
+	Error    string    `json:"error,omitempty"`
+	Attempts []*Job    `json:"attempts"`
+	Created  time.Time `json:"created"`
+}
+
+// 结束状态之外的run还会变化
+func (r *Run) Finished() bool {
+	switch r.State {
+	case "succeeded", "failed", "killed", "oom", "lost", "cancelled", "flaky-passed":
+		return true
+	}
+	return false
+}
+
+type QueueItem struct {
+	Position int       `json:"position"`
+	RunID    string    `json:"run_id"`
+	Project  string    `json:"project"`
+	Priority int       `json:"priority"`
+	QueuedAt time.Time `json:"queued_at"`
+}
+
+type QueueStatus struct {
+	MaxRuns int         `json:"max_runs"`
+	Active  int         `json:"active"`
+	Pending []QueueItem `json:"pending"`
+}
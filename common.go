@@ -11,6 +11,8 @@ type ClientOpts struct {
 	AccessKey string
 	SecretKey string
 	Timeout   time.Duration
+	Identity  *AgentIdentity
+	Transport http.RoundTripper
 }
 
 type BaseClient struct {
@@ -39,14 +41,17 @@ func (c BaseClient) DoAction(path string, op Op) (resp *http.Response, err error
 	if Timeout == 0 {
 		Timeout = DefaultTimeOut
 	}
-	client := &http.Client{Timeout: Timeout}
+	client := &http.Client{Timeout: Timeout, Transport: c.Opts.Transport}
 
 	req, err := http.NewRequest(op.Name, c.Opts.Url+path, nil)
 	if err != nil {
-		panic(err.Error())
+		return nil, err
 	}
 
 	req.SetBasicAuth(c.Opts.AccessKey, c.Opts.SecretKey)
+	if c.Opts.Identity != nil {
+		c.Opts.Identity.apply(req)
+	}
 	resp, err = client.Do(req)
 	return
 
@@ -59,14 +64,17 @@ func (c BaseClient) DoPost(path string, data []byte) (resp *http.Response, err e
 	if Timeout == 0 {
 		Timeout = DefaultTimeOut
 	}
-	client := &http.Client{Timeout: Timeout}
+	client := &http.Client{Timeout: Timeout, Transport: c.Opts.Transport}
 
 	req, err := http.NewRequest("POST", c.Opts.Url+path, body)
 	if err != nil {
-		panic(err.Error())
+		return nil, err
 	}
 
 	req.SetBasicAuth(c.Opts.AccessKey, c.Opts.SecretKey)
+	if c.Opts.Identity != nil {
+		c.Opts.Identity.apply(req)
+	}
 	resp, err = client.Do(req)
 	return
 
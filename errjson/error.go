@@ -19,6 +19,16 @@ func (e RespError) Error() string {
 	return e.Data
 }
 
+// 所有错误类型都内嵌了RespError,JsonReturnHandler据此返回对应的状态码
+type Responder interface {
+	error
+	Response() RespError
+}
+
+func (e RespError) Response() RespError {
+	return e
+}
+
 type NotFoundError struct {
 	RespError
 }
@@ -102,3 +112,97 @@ func NewInternalServerError(msg string) InternalServerError {
 	}
 	return e
 }
+
+//503
+type ServiceUnavailableError struct {
+	RespError
+}
+
+func NewServiceUnavailableError(msg string) ServiceUnavailableError {
+	e := ServiceUnavailableError{
+		RespError: RespError{
+			Type:   "error",
+			Status: http.StatusServiceUnavailable,
+			Code:   "Service Unavailable",
+			Data:   msg,
+		},
+	}
+	return e
+}
+
+//镜像内容和期望的digest不一致
+type IntegrityError struct {
+	RespError
+}
+
+func NewIntegrityError(msg string) IntegrityError {
+	e := IntegrityError{
+		RespError: RespError{
+			Type:   "error",
+			Status: http.StatusConflict,
+			Code:   "Integrity Check Failed",
+			Data:   msg,
+		},
+	}
+	return e
+}
+
+//409
+type ConflictError struct {
+	RespError
+}
+
+func NewConflictError(msg string) ConflictError {
+	e := ConflictError{
+		RespError: RespError{
+			Type:   "error",
+			Status: http.StatusConflict,
+			Code:   "Conflict",
+			Data:   msg,
+		},
+	}
+	return e
+}
+
+//413
+type RequestEntityTooLargeError struct {
+	RespError
+}
+
+func NewRequestEntityTooLargeError(msg string) RequestEntityTooLargeError {
+	e := RequestEntityTooLargeError{
+		RespError: RespError{
+			Type:   "error",
+			Status: http.StatusRequestEntityTooLarge,
+			Code:   "Request Entity Too Large",
+			Data:   msg,
+		},
+	}
+	return e
+}
+
+// 客户端把返回的错误body转换回对应的类型
+func Typed(e RespError) error {
+	switch e.Status {
+	case http.StatusNotFound:
+		return NotFoundError{e}
+	case http.StatusForbidden:
+		return ErrForbidden{e}
+	case ErrorNotValidEntity:
+		return NotValidEntityError{e}
+	case http.StatusUnauthorized:
+		return UnauthorizedError{e}
+	case http.StatusServiceUnavailable:
+		return ServiceUnavailableError{e}
+	case http.StatusConflict:
+		if e.Code == NewIntegrityError("").Code {
+			return IntegrityError{e}
+		}
+		return ConflictError{e}
+	case http.StatusRequestEntityTooLarge:
+		return RequestEntityTooLargeError{e}
+	case http.StatusInternalServerError:
+		return InternalServerError{e}
+	}
+	return e
+}
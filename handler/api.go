@@ -0,0 +1,171 @@
+package handler
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"time"
+
+	"test/errjson"
+
+	"test/Godeps/_workspace/src/github.com/gorilla/context"
+)
+
+const (
+	APIVersion      = "v1"
+	RequestIDHeader = "X-Request-Id"
+)
+
+type Meta struct {
+	APIVersion string `json:"api_version"`
+	Count      *int   `json:"count,omitempty"` //data是列表时的长度
+	Timestamp  int64  `json:"timestamp"`
+}
+
+// /v1下所有接口的返回格式,成功时有data,失败时有error
+type Envelope struct {
+	Data      interface{}        `json:"data"`
+	Error     *errjson.RespError `json:"error,omitempty"`
+	Meta      Meta               `json:"meta"`
+	RequestID string             `json:"request_id"`
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func RequestID(r *http.Request) string {
+	if v, ok := context.GetOk(r, requestIDKey); ok {
+		return v.(string)
+	}
+	return ""
+}
+
+// 经反向连接转发的请求,响应会整体缓存后回传,不能流式输出
+func SetTunneled(r *http.Request) {
+	context.Set(r, tunnelKey, true)
+}
+
+func viaTunnel(r *http.Request) bool {
+	_, ok := context.GetOk(r, tunnelKey)
+	return ok
+}
+
+// 沿用调用方或RequestIDs中间件已经给的ID
+func setRequestID(w http.ResponseWriter, r *http.Request) string {
+	id := RequestID(r)
+	if len(id) == 0 {
+		id = r.Header.Get(RequestIDHeader)
+	}
+	if len(id) == 0 {
+		id = newRequestID()
+	}
+	context.Set(r, requestIDKey, id)
+	w.Header().Set(RequestIDHeader, id)
+	return id
+}
+
+func isV1(r *http.Request) bool {
+	_, ok := context.GetOk(r, apiVersionKey)
+	return ok
+}
+
+func newEnvelope(r *http.Request, data interface{}) Envelope {
+	e := Envelope{
+		Data:      data,
+		Meta:      Meta{APIVersion: APIVersion, Timestamp: time.Now().Unix()},
+		RequestID: RequestID(r),
+	}
+	if v := reflect.ValueOf(data); v.Kind() == reflect.Slice {
+		n := v.Len()
+		e.Meta.Count = &n
+	}
+	return e
+}
+
+func writeEnvelope(w http.ResponseWriter, status int, e Envelope) {
+	byteContent, err := json.Marshal(e)
+	if err != nil {
+		log.Errorf("marshal response fail:%v", err)
+		status = http.StatusInternalServerError
+		byteContent = []byte(`{"data":null,"error":{"type":"error","status":500,"code":"internel server error","data":"marshal response fail"}}`)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(byteContent)
+}
+
+// 旧接口直接返回数据,/v1包一层Envelope
+func writeJSON(w http.ResponseWriter, r *http.Request, v interface{}) error {
+	if isV1(r) {
+		writeEnvelope(w, http.StatusOK, newEnvelope(r, v))
+		return nil
+	}
+	byteContent, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(byteContent)
+	return nil
+}
+
+// 推迟WriteHeader,handler没有写body时由V1补上Envelope
+type v1Writer struct {
+	http.ResponseWriter
+	status int
+	wrote  bool
+}
+
+func (w *v1Writer) WriteHeader(status int) {
+	if !w.wrote {
+		w.status = status
+	}
+}
+
+func (w *v1Writer) Write(b []byte) (int, error) {
+	if !w.wrote {
+		w.wrote = true
+		if w.status == 0 {
+			w.status = http.StatusOK
+		}
+		w.ResponseWriter.WriteHeader(w.status)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *v1Writer) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func V1(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		setRequestID(w, r)
+		context.Set(r, apiVersionKey, APIVersion)
+
+		vw := &v1Writer{ResponseWriter: w}
+		h.ServeHTTP(vw, r)
+		if !vw.wrote {
+			status := vw.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			writeEnvelope(w, status, newEnvelope(r, nil))
+		}
+	})
+}
+
+// 没有/v1前缀的旧接口,保留兼容,提示调用方迁移
+func Deprecated(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Deprecation", "true")
+		w.Header().Set("Link", "</"+APIVersion+r.URL.Path+`>; rel="successor-version"`)
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,381 @@
+package handler
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"test/errjson"
+
+	"test/Godeps/_workspace/src/github.com/gorilla/mux"
+)
+
+const (
+	maxAuditSize = 10 << 20
+	auditBackups = 5
+)
+
+// 每条记录带上前一条的hash,中间有记录被改动或删除时链就断了;
+// hash是用审计密钥算的HMAC,只能改日志文件的人无法重新算出整条链
+type AuditRecord struct {
+	Seq        int64    `json:"seq"`
+	Time       int64    `json:"time"` //unix毫秒
+	RequestID  string   `json:"request_id,omitempty"`
+	Caller     string   `json:"caller"`
+	RemoteAddr string   `json:"remote_addr"`
+	Action     string   `json:"action"`
+	Method     string   `json:"method"`
+	Path       string   `json:"path"`
+	Images     []string `json:"images,omitempty"`
+	Status     int      `json:"status"`
+	Outcome    string   `json:"outcome"`
+	Duration   int64    `json:"duration_ms"`
+	PrevHash   string   `json:"prev_hash"`
+	Hash       string   `json:"hash"`
+}
+
+type AuditVerify struct {
+	OK       bool  `json:"ok"`
+	Records  int   `json:"records"`
+	BrokenAt int64 `json:"broken_at,omitempty"`
+}
+
+var audit struct {
+	sync.Mutex
+	key      []byte
+	path     string
+	fp       *os.File
+	size     int64
+	seq      int64
+	prevHash string
+}
+
+func (rec AuditRecord) digest(key []byte) string {
+	rec.Hash = ""
+	byteContent, _ := json.Marshal(rec)
+	mac := hmac.New(sha256.New, key)
+	mac.Write(byteContent)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// 当前文件为空(刚轮转过)时从最新的备份里找
+func lastAuditRecord(path string) *AuditRecord {
+	for n := 0; n <= auditBackups; n++ {
+		name := path
+		if n > 0 {
+			name = backupName(path, n)
+		}
+		if records := readAuditFile(name); len(records) != 0 {
+			return &records[len(records)-1]
+		}
+	}
+	return nil
+}
+
+// 打开审计日志,从最后一条记录接上hash链.key要和日志分开保存
+func SetAuditLog(path string, key []byte) error {
+	if len(key) == 0 {
+		return errors.New("audit key is empty")
+	}
+	audit.Lock()
+	defer audit.Unlock()
+
+	last := lastAuditRecord(path)
+	fp, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := fp.Stat()
+	if err != nil {
+		fp.Close()
+		return err
+	}
+	if audit.fp != nil {
+		audit.fp.Close()
+	}
+	audit.key = key
+	audit.path = path
+	audit.fp = fp
+	audit.size = info.Size()
+	if last != nil {
+		audit.seq = last.Seq
+		audit.prevHash = last.Hash
+	}
+	return nil
+}
+
+func backupName(path string, n int) string {
+	return path + "." + strconv.Itoa(n)
+}
+
+// 调用时持有audit锁;audit.log.1最新,超出个数的丢弃
+func rotateAudit() error {
+	audit.fp.Close()
+	os.Remove(backupName(audit.path, auditBackups))
+	for n := auditBackups - 1; n >= 1; n-- {
+		os.Rename(backupName(audit.path, n), backupName(audit.path, n+1))
+	}
+	if err := os.Rename(audit.path, backupName(audit.path, 1)); err != nil {
+		return err
+	}
+	fp, err := os.OpenFile(audit.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		audit.fp = nil
+		return err
+	}
+	audit.fp = fp
+	audit.size = 0
+	return nil
+}
+
+func appendAudit(rec *AuditRecord) {
+	audit.Lock()
+	defer audit.Unlock()
+	if audit.fp == nil {
+		return
+	}
+
+	audit.seq++
+	rec.Seq = audit.seq
+	rec.PrevHash = audit.prevHash
+	rec.Hash = rec.digest(audit.key)
+	line, err := json.Marshal(rec)
+	if err != nil {
+		log.Errorf("marshal audit record fail:%v", err)
+		return
+	}
+	line = append(line, '\n')
+
+	if audit.size+int64(len(line)) > maxAuditSize {
+		if err := rotateAudit(); err != nil {
+			log.Errorf("rotate audit log fail:%v", err)
+			return
+		}
+	}
+	n, err := audit.fp.Write(line)
+	audit.size += int64(n)
+	if err != nil {
+		log.Errorf("write audit log fail:%v", err)
+		return
+	}
+	audit.prevHash = rec.Hash
+}
+
+func readAuditFile(path string) []AuditRecord {
+	byteContent, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	var records []AuditRecord
+	scanner := bufio.NewScanner(bytes.NewReader(byteContent))
+	scanner.Buffer(make([]byte, 64*1024), maxAuditSize)
+	for scanner.Scan() {
+		var rec AuditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			log.Warnf("skip invalid audit record in %s:%v", path, err)
+			continue
+		}
+		records = append(records, rec)
+	}
+	return records
+}
+
+// 从最旧的备份读到当前文件
+func auditRecords() []AuditRecord {
+	audit.Lock()
+	path := audit.path
+	audit.Unlock()
+	if len(path) == 0 {
+		return nil
+	}
+
+	var records []AuditRecord
+	for n := auditBackups; n >= 1; n-- {
+		records = append(records, readAuditFile(backupName(path, n))...)
+	}
+	return append(records, readAuditFile(path)...)
+}
+
+// 记录请求里涉及的镜像:路径里的image/tag,以及body里的image/tag、old/new
+func auditImages(r *http.Request, body []byte) []string {
+	var images []string
+	vars := mux.Vars(r)
+	if len(vars["image"]) != 0 {
+		images = append(images, imageRef(vars["image"], vars["tag"]))
+	}
+	var fields struct {
+		Image string `json:"image"`
+		Tag   string `json:"tag"`
+		Old   string `json:"old"`
+		New   string `json:"new"`
+	}
+	if len(body) != 0 && json.Unmarshal(body, &fields) == nil {
+		if len(fields.Image) != 0 {
+			images = append(images, imageRef(fields.Image, fields.Tag))
+		}
+		for _, name := range []string{fields.Old, fields.New} {
+			if len(name) != 0 {
+				images = append(images, name)
+			}
+		}
+	}
+	return images
+}
+
+type errReader struct {
+	err error
+}
+
+func (r errReader) Read([]byte) (int, error) {
+	if r.err == nil {
+		return 0, io.EOF
+	}
+	return 0, r.err
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+func (w *statusRecorder) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// 包在认证外面,认证失败的请求也会记录
+func Audit(action string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		var body []byte
+		if r.Body != nil {
+			var err error
+			body, err = ioutil.ReadAll(r.Body)
+			r.Body.Close()
+			//读取出错(比如超过大小限制)时留给后面的handler报错
+			r.Body = ioutil.NopCloser(io.MultiReader(bytes.NewReader(body), errReader{err}))
+		}
+
+		rec := &statusRecorder{ResponseWriter: w}
+		h.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+
+		outcome := "success"
+		if rec.status >= 400 {
+			outcome = "failure"
+		}
+		appendAudit(&AuditRecord{
+			Time:       start.UnixNano() / int64(time.Millisecond),
+			RequestID:  RequestID(r),
+			Caller:     Caller(r),
+			RemoteAddr: r.RemoteAddr,
+			Action:     action,
+			Method:     r.Method,
+			Path:       r.URL.Path,
+			Images:     auditImages(r, body),
+			Status:     rec.status,
+			Outcome:    outcome,
+			Duration:   int64(time.Since(start) / time.Millisecond),
+		})
+	})
+}
+
+// since/until 是unix秒或RFC3339
+func parseAuditTime(s string) (int64, error) {
+	if sec, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return sec * 1000, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return 0, err
+	}
+	return t.UnixNano() / int64(time.Millisecond), nil
+}
+
+func GetAudit(w http.ResponseWriter, r *http.Request) error {
+	q := r.URL.Query()
+	var since, until int64
+	var err error
+	if s := q.Get("since"); len(s) != 0 {
+		if since, err = parseAuditTime(s); err != nil {
+			return errjson.NewNotValidEntityError("invalid since " + s)
+		}
+	}
+	if s := q.Get("until"); len(s) != 0 {
+		if until, err = parseAuditTime(s); err != nil {
+			return errjson.NewNotValidEntityError("invalid until " + s)
+		}
+	}
+	action := q.Get("action")
+
+	records := []AuditRecord{}
+	for _, rec := range auditRecords() {
+		if since != 0 && rec.Time < since {
+			continue
+		}
+		if until != 0 && rec.Time > until {
+			continue
+		}
+		if len(action) != 0 && rec.Action != action {
+			continue
+		}
+		records = append(records, rec)
+	}
+
+	return writeJSON(w, r, records)
+}
+
+// 检查保留下来的记录hash链是否完整;最旧的备份被轮转丢弃不算断链
+func VerifyAudit(w http.ResponseWriter, r *http.Request) error {
+	return writeJSON(w, r, verifyAuditChain())
+}
+
+func verifyAuditChain() AuditVerify {
+	audit.Lock()
+	key := audit.key
+	audit.Unlock()
+	records := auditRecords()
+	result := AuditVerify{OK: true, Records: len(records)}
+	for i, rec := range records {
+		broken := !hmac.Equal([]byte(rec.digest(key)), []byte(rec.Hash))
+		if i > 0 && (rec.PrevHash != records[i-1].Hash || rec.Seq != records[i-1].Seq+1) {
+			broken = true
+		}
+		if broken {
+			result.OK = false
+			result.BrokenAt = rec.Seq
+			log.Warnf("audit chain broken at record %d", rec.Seq)
+			break
+		}
+	}
+	return result
+}
@@ -0,0 +1,131 @@
+package handler
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var testAuditKey = []byte("0123456789abcdef0123456789abcdef")
+
+func openTestAudit(t *testing.T, path string) {
+	if err := SetAuditLog(path, testAuditKey); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func appendTestRecords(n int) {
+	for i := 0; i < n; i++ {
+		appendAudit(&AuditRecord{Action: "test", Method: "POST", Path: "/x"})
+	}
+}
+
+func rotateTestAudit(t *testing.T) {
+	audit.Lock()
+	err := rotateAudit()
+	audit.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func resetAudit() {
+	audit.Lock()
+	if audit.fp != nil {
+		audit.fp.Close()
+	}
+	audit.fp, audit.path, audit.key, audit.seq, audit.prevHash, audit.size = nil, "", nil, 0, "", 0
+	audit.Unlock()
+}
+
+func rewrite(t *testing.T, path string, fn func([]AuditRecord) []AuditRecord) {
+	records := fn(readAuditFile(path))
+	var lines []string
+	for _, rec := range records {
+		b, _ := json.Marshal(rec)
+		lines = append(lines, string(b))
+	}
+	if err := ioutil.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAuditChain(t *testing.T) {
+	cases := []struct {
+		name    string
+		setup   func(t *testing.T, path string)
+		records int
+		ok      bool
+	}{
+		{"append", func(t *testing.T, path string) {
+			appendTestRecords(3)
+		}, 3, true},
+		{"rotate", func(t *testing.T, path string) {
+			appendTestRecords(2)
+			rotateTestAudit(t)
+			appendTestRecords(2)
+		}, 4, true},
+		{"restart after rotation", func(t *testing.T, path string) {
+			appendTestRecords(2)
+			rotateTestAudit(t)
+			openTestAudit(t, path)
+			appendTestRecords(1)
+		}, 3, true},
+		{"restart", func(t *testing.T, path string) {
+			appendTestRecords(2)
+			openTestAudit(t, path)
+			appendTestRecords(1)
+		}, 3, true},
+		{"modified", func(t *testing.T, path string) {
+			appendTestRecords(3)
+			rewrite(t, path, func(records []AuditRecord) []AuditRecord {
+				records[1].Caller = "someone"
+				return records
+			})
+		}, 3, false},
+		{"deleted", func(t *testing.T, path string) {
+			appendTestRecords(3)
+			rewrite(t, path, func(records []AuditRecord) []AuditRecord {
+				return append(records[:1], records[2:]...)
+			})
+		}, 2, false},
+		//不知道密钥时,即使重新计算了整条链也通不过校验
+		{"rehashed without key", func(t *testing.T, path string) {
+			appendTestRecords(3)
+			rewrite(t, path, func(records []AuditRecord) []AuditRecord {
+				prev := ""
+				for i := range records {
+					records[i].Caller = "someone"
+					records[i].PrevHash = prev
+					records[i].Hash = ""
+					b, _ := json.Marshal(records[i])
+					sum := sha256.Sum256(b)
+					records[i].Hash = hex.EncodeToString(sum[:])
+					prev = records[i].Hash
+				}
+				return records
+			})
+		}, 3, false},
+	}
+	for _, c := range cases {
+		dir, err := ioutil.TempDir("", "audit")
+		if err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(dir, "audit.log")
+		openTestAudit(t, path)
+		c.setup(t, path)
+
+		result := verifyAuditChain()
+		if result.Records != c.records || result.OK != c.ok {
+			t.Errorf("%s: got %+v, want %d records ok=%v", c.name, result, c.records, c.ok)
+		}
+		resetAudit()
+		os.RemoveAll(dir)
+	}
+}
@@ -0,0 +1,239 @@
+package handler
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"test/errjson"
+
+	"test/Godeps/_workspace/src/github.com/gorilla/context"
+)
+
+const (
+	AuthKeyHeader       = "X-Auth-Key"
+	AuthTimestampHeader = "X-Auth-Timestamp"
+	AuthSignatureHeader = "X-Auth-Signature"
+	//调用方每次请求(包括重试)都生成新的随机值,同一秒内内容相同的请求签名也不同
+	AuthNonceHeader = "X-Auth-Nonce"
+
+	//签名请求的时间戳允许的偏差,也是防重放缓存的有效期
+	authMaxSkew = 5 * time.Minute
+)
+
+type ctxKey int
+
+const (
+	callerKey ctxKey = iota
+	requestIDKey
+	apiVersionKey
+	tunnelKey
+)
+
+// 权限,admin包含所有权限,write包含同一类资源的read
+const (
+	PermImagesRead  = "images:read"
+	PermImagesWrite = "images:write"
+	PermRunsRead    = "runs:read"
+	PermRunsWrite   = "runs:write"
+	PermAdmin       = "admin"
+)
+
+var permImplied = map[string][]string{
+	PermImagesRead: {PermImagesWrite},
+	PermRunsRead:   {PermRunsWrite},
+}
+
+// 注册时由测试服务器下发;没有scopes的key是admin
+type AccessKey struct {
+	AccessKey string   `json:"access_key"`
+	SecretKey string   `json:"secret_key"`
+	Scopes    []string `json:"scopes,omitempty"`
+}
+
+var (
+	authLock   sync.RWMutex
+	accessKeys = make(map[string]AccessKey)
+
+	replayLock sync.Mutex
+	seenNonces = make(map[string]time.Time)
+)
+
+func SetAccessKeys(keys []AccessKey) {
+	m := make(map[string]AccessKey)
+	for _, k := range keys {
+		if len(k.AccessKey) != 0 && len(k.SecretKey) != 0 {
+			if len(k.Scopes) == 0 {
+				k.Scopes = []string{PermAdmin}
+			}
+			m[k.AccessKey] = k
+		}
+	}
+	authLock.Lock()
+	accessKeys = m
+	authLock.Unlock()
+	log.Infof("%d access key(s) installed", len(m))
+}
+
+func secretOf(access string) (string, bool) {
+	authLock.RLock()
+	defer authLock.RUnlock()
+	k, ok := accessKeys[access]
+	return k.SecretKey, ok
+}
+
+func hasPermission(access string, perm string) bool {
+	authLock.RLock()
+	k, ok := accessKeys[access]
+	authLock.RUnlock()
+	if !ok {
+		return false
+	}
+	for _, scope := range k.Scopes {
+		if scope == PermAdmin || scope == perm {
+			return true
+		}
+		for _, implied := range permImplied[perm] {
+			if scope == implied {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// 签名内容: METHOD\nURI\nTIMESTAMP\nNONCE\nhex(sha256(body))
+func SignRequest(secret, method, uri, timestamp, nonce string, body []byte) string {
+	sum := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(method + "\n" + uri + "\n" + timestamp + "\n" + nonce + "\n" + hex.EncodeToString(sum[:])))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// 同一个access key的nonce只能用一次
+func checkReplay(access, nonce string, now time.Time) bool {
+	key := access + "\n" + nonce
+	replayLock.Lock()
+	defer replayLock.Unlock()
+	for k, t := range seenNonces {
+		if now.Sub(t) > 2*authMaxSkew {
+			delete(seenNonces, k)
+		}
+	}
+	if _, ok := seenNonces[key]; ok {
+		return false
+	}
+	seenNonces[key] = now
+	return true
+}
+
+func verifySigned(r *http.Request) (string, error) {
+	access := r.Header.Get(AuthKeyHeader)
+	timestamp := r.Header.Get(AuthTimestampHeader)
+	sig := r.Header.Get(AuthSignatureHeader)
+	nonce := r.Header.Get(AuthNonceHeader)
+
+	secret, ok := secretOf(access)
+	if !ok {
+		return "", errjson.NewUnauthorizedError("unknown access key")
+	}
+	if len(nonce) == 0 {
+		return "", errjson.NewUnauthorizedError("nonce required")
+	}
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return "", errjson.NewUnauthorizedError("invalid timestamp")
+	}
+	now := time.Now()
+	if skew := now.Sub(time.Unix(ts, 0)); skew > authMaxSkew || skew < -authMaxSkew {
+		return "", errjson.NewUnauthorizedError("timestamp out of range")
+	}
+
+	var body []byte
+	if r.Body != nil {
+		body, err = ioutil.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			return "", err
+		}
+		//后面的handler还要读取body
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+
+	expect := SignRequest(secret, r.Method, r.URL.RequestURI(), timestamp, nonce, body)
+	if !hmac.Equal([]byte(expect), []byte(sig)) {
+		return "", errjson.NewUnauthorizedError("signature mismatch")
+	}
+	if !checkReplay(access, nonce, now) {
+		return "", errjson.NewUnauthorizedError("replayed request")
+	}
+	return access, nil
+}
+
+func verifyBasic(r *http.Request) (string, error) {
+	access, secret, ok := r.BasicAuth()
+	if !ok {
+		return "", errjson.NewUnauthorizedError("credentials required")
+	}
+	expect, ok := secretOf(access)
+	if !ok || subtle.ConstantTimeCompare([]byte(expect), []byte(secret)) != 1 {
+		return "", errjson.NewUnauthorizedError("invalid credentials")
+	}
+	return access, nil
+}
+
+func Authenticate(r *http.Request) (string, error) {
+	if len(r.Header.Get(AuthSignatureHeader)) != 0 {
+		return verifySigned(r)
+	}
+	return verifyBasic(r)
+}
+
+// 通过认证的调用方,后续用于审计和权限检查
+func Caller(r *http.Request) string {
+	if v, ok := context.GetOk(r, callerKey); ok {
+		return v.(string)
+	}
+	return ""
+}
+
+// perm为空时要求admin
+func RequireAuth(perm string, h http.Handler) http.Handler {
+	if len(perm) == 0 {
+		perm = PermAdmin
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		access, err := Authenticate(r)
+		if err != nil {
+			log.Warnf("reject %s %s from %s: %v", r.Method, r.URL.Path, r.RemoteAddr, err)
+			if _, ok := err.(errjson.UnauthorizedError); ok {
+				w.Header().Set("WWW-Authenticate", `Basic realm="autotest"`)
+			}
+			writeError(w, r, err)
+			return
+		}
+		context.Set(r, callerKey, access)
+		if !hasPermission(access, perm) {
+			log.Warnf("reject %s %s from %s: %s lacks %s", r.Method, r.URL.Path, r.RemoteAddr, access, perm)
+			writeError(w, r, errjson.NewErrForbidden(access+" lacks permission "+perm))
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func Health(w http.ResponseWriter, r *http.Request) error {
+	if isV1(r) {
+		return writeJSON(w, r, map[string]string{"status": "ok"})
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte("ok"))
+	return nil
+}
@@ -0,0 +1,121 @@
+package handler
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"test/errjson"
+)
+
+func signedRequest(secret, method, uri, body, nonce string, ts time.Time) *http.Request {
+	timestamp := strconv.FormatInt(ts.Unix(), 10)
+	r := httptest.NewRequest(method, uri, strings.NewReader(body))
+	r.Header.Set(AuthKeyHeader, "ak")
+	r.Header.Set(AuthTimestampHeader, timestamp)
+	r.Header.Set(AuthNonceHeader, nonce)
+	r.Header.Set(AuthSignatureHeader, SignRequest(secret, method, uri, timestamp, nonce, []byte(body)))
+	return r
+}
+
+func resetReplay() {
+	replayLock.Lock()
+	seenNonces = make(map[string]time.Time)
+	replayLock.Unlock()
+}
+
+func TestAuthenticate(t *testing.T) {
+	resetReplay()
+	SetAccessKeys([]AccessKey{{AccessKey: "ak", SecretKey: "sk"}})
+	now := time.Now()
+	tampered := signedRequest("sk", "POST", "/v1/runs", `{"image":"a"}`, "n1", now)
+	tampered.Body = httptest.NewRequest("POST", "/", strings.NewReader(`{"image":"b"}`)).Body
+	basic := httptest.NewRequest("GET", "/v1/runs", nil)
+	basic.SetBasicAuth("ak", "sk")
+	wrongBasic := httptest.NewRequest("GET", "/v1/runs", nil)
+	wrongBasic.SetBasicAuth("ak", "nope")
+
+	cases := []struct {
+		name string
+		r    *http.Request
+		ok   bool
+	}{
+		{"signed", signedRequest("sk", "POST", "/v1/runs?x=1", `{"image":"a"}`, "n2", now), true},
+		{"wrong secret", signedRequest("nope", "POST", "/v1/runs", "", "n3", now), false},
+		{"tampered body", tampered, false},
+		{"no nonce", signedRequest("sk", "GET", "/v1/runs", "", "", now), false},
+		{"too old", signedRequest("sk", "GET", "/v1/runs", "", "n4", now.Add(-authMaxSkew-time.Minute)), false},
+		{"too new", signedRequest("sk", "GET", "/v1/runs", "", "n5", now.Add(authMaxSkew+time.Minute)), false},
+		{"basic", basic, true},
+		{"wrong basic", wrongBasic, false},
+		{"anonymous", httptest.NewRequest("GET", "/v1/runs", nil), false},
+	}
+	for _, c := range cases {
+		access, err := Authenticate(c.r)
+		if c.ok && (err != nil || access != "ak") {
+			t.Errorf("%s: got %q, %v", c.name, access, err)
+		}
+		if !c.ok {
+			if _, ok := err.(errjson.UnauthorizedError); !ok {
+				t.Errorf("%s: got %q, %v, want unauthorized", c.name, access, err)
+			}
+		}
+	}
+}
+
+// 同一个nonce第二次使用要被拒绝,同一秒内内容相同但nonce不同的请求都能通过;
+// 签过名的body还能被handler读到
+func TestAuthenticateReplay(t *testing.T) {
+	resetReplay()
+	SetAccessKeys([]AccessKey{{AccessKey: "ak", SecretKey: "sk"}})
+	now := time.Now()
+	first := signedRequest("sk", "POST", "/v1/drain", "body", "n1", now)
+	if _, err := Authenticate(first); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := ioutil.ReadAll(first.Body); string(b) != "body" {
+		t.Errorf("body %q after authentication", b)
+	}
+	if _, err := Authenticate(signedRequest("sk", "POST", "/v1/drain", "body", "n2", now)); err != nil {
+		t.Errorf("identical request with a new nonce rejected: %v", err)
+	}
+	if _, err := Authenticate(signedRequest("sk", "POST", "/v1/drain", "body", "n1", now)); err == nil {
+		t.Errorf("replayed request accepted")
+	}
+	if _, err := Authenticate(signedRequest("sk", "GET", "/v1/runs", "", "n1", now)); err == nil {
+		t.Errorf("reused nonce accepted")
+	}
+}
+
+func TestHasPermission(t *testing.T) {
+	SetAccessKeys([]AccessKey{
+		{AccessKey: "admin", SecretKey: "s"},
+		{AccessKey: "reader", SecretKey: "s", Scopes: []string{PermRunsRead}},
+		{AccessKey: "writer", SecretKey: "s", Scopes: []string{PermImagesWrite, PermRunsRead}},
+	})
+	cases := []struct {
+		access, perm string
+		want         bool
+	}{
+		{"admin", PermAdmin, true},
+		{"admin", PermImagesWrite, true},
+		{"reader", PermRunsRead, true},
+		{"reader", PermRunsWrite, false},
+		{"reader", PermImagesRead, false},
+		{"reader", PermAdmin, false},
+		{"writer", PermImagesWrite, true},
+		//write包含read,反过来不行
+		{"writer", PermImagesRead, true},
+		{"writer", PermRunsWrite, false},
+		{"unknown", PermRunsRead, false},
+	}
+	for _, c := range cases {
+		if got := hasPermission(c.access, c.perm); got != c.want {
+			t.Errorf("%s %s: got %v, want %v", c.access, c.perm, got, c.want)
+		}
+	}
+}
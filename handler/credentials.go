@@ -0,0 +1,200 @@
+package handler
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+
+	docker "test/Godeps/_workspace/src/github.com/fsouza/go-dockerclient"
+)
+
+// 按仓库地址保存的登录信息,可选加密保存到文件
+type credStore struct {
+	sync.RWMutex
+	entries map[string]UserInfo
+	path    string
+	key     []byte
+}
+
+var creds = &credStore{entries: make(map[string]UserInfo)}
+
+// 日志里不出现密码
+func (u UserInfo) String() string {
+	return u.User + "@" + u.Server
+}
+
+// https://host:port/v1/ 和 host:port 是同一个仓库
+func normalizeServer(server string) string {
+	server = strings.TrimPrefix(server, "https://")
+	server = strings.TrimPrefix(server, "http://")
+	if i := strings.Index(server, "/"); i >= 0 {
+		server = server[:i]
+	}
+	server = strings.ToLower(server)
+	//docker hub有好几个名字
+	switch server {
+	case "docker.io", "registry-1.docker.io", "registry.hub.docker.com":
+		return dockerHubServer
+	}
+	return server
+}
+
+// 镜像名的第一段带'.'或':',或者是localhost时,才是仓库地址
+func registryOf(image string) string {
+	i := strings.Index(image, "/")
+	if i < 0 {
+		return ""
+	}
+	host := image[:i]
+	if strings.ContainsAny(host, ".:") || host == "localhost" {
+		return normalizeServer(host)
+	}
+	return ""
+}
+
+func (s *credStore) get(server string) (UserInfo, bool) {
+	s.RLock()
+	defer s.RUnlock()
+	info, ok := s.entries[normalizeServer(server)]
+	return info, ok
+}
+
+func (s *credStore) set(info UserInfo) error {
+	info.Server = normalizeServer(info.Server)
+	s.Lock()
+	defer s.Unlock()
+	s.entries[info.Server] = info
+	return s.save()
+}
+
+// 调用时持有写锁
+func (s *credStore) save() error {
+	if len(s.path) == 0 {
+		return nil
+	}
+	plain, err := json.Marshal(s.entries)
+	if err != nil {
+		return err
+	}
+	sealed, err := seal(s.key, plain)
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, sealed, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// AES-256-GCM, 格式: nonce || 密文
+func seal(key, plain []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plain, nil), nil
+}
+
+func open(key, sealed []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("credential file is truncated")
+	}
+	nonce := sealed[:gcm.NonceSize()]
+	return gcm.Open(nil, nonce, sealed[gcm.NonceSize():], nil)
+}
+
+// 开启加密保存,并加载已保存的登录信息;secret是任意长度的口令
+func PersistCredentials(path string, secret []byte) error {
+	if len(secret) == 0 {
+		return errors.New("credential key is empty")
+	}
+	sum := sha256.Sum256(secret)
+
+	creds.Lock()
+	defer creds.Unlock()
+	creds.path = path
+	creds.key = sum[:]
+
+	sealed, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	plain, err := open(creds.key, sealed)
+	if err != nil {
+		return errors.New("decrypt credential file fail, wrong key?")
+	}
+	entries := make(map[string]UserInfo)
+	if err := json.Unmarshal(plain, &entries); err != nil {
+		return err
+	}
+	for server, info := range entries {
+		creds.entries[server] = info
+	}
+	log.Infof("%d credential(s) loaded from %s", len(entries), path)
+	return nil
+}
+
+// 测试服务器下发的登录信息,不做校验
+func SetCredentials(info UserInfo) {
+	if len(info.Server) == 0 {
+		info.Server = Registries().Primary.Address
+	}
+	if err := creds.set(info); err != nil {
+		log.Errorf("save credentials for %s fail:%v", info.Server, err)
+		return
+	}
+	log.Infof("credentials for %s installed", info)
+}
+
+// 向docker daemon校验登录信息,通过后才保存
+func checkCredentials(info UserInfo) error {
+	return globalClient.AuthCheck(&docker.AuthConfiguration{
+		Username:      info.User,
+		Password:      info.Password,
+		ServerAddress: info.Server,
+	})
+}
+
+// 先用agent自己保存的,没有再用本机docker客户端的
+func credentialsFor(server string) docker.AuthConfiguration {
+	if len(server) == 0 {
+		server = dockerHubServer
+	}
+	info, ok := creds.get(server)
+	if !ok {
+		conf, _ := dockerFallback(server)
+		return conf
+	}
+	return docker.AuthConfiguration{
+		Username:      info.User,
+		Password:      info.Password,
+		ServerAddress: info.Server,
+	}
+}
@@ -0,0 +1,73 @@
+package handler
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"test/errjson"
+)
+
+func validDigest(digest string) bool {
+	if !strings.HasPrefix(digest, "sha256:") {
+		return false
+	}
+	sum, err := hex.DecodeString(strings.TrimPrefix(digest, "sha256:"))
+	return err == nil && len(sum) == 32
+}
+
+// RepoDigests里是manifest的digest(repo@sha256:...),ID是镜像配置的digest,两者都认
+func imageHasDigest(image, tag, digest string) (bool, error) {
+	info, err := globalClient.InspectImage(imageRef(image, tag))
+	if err != nil {
+		return false, err
+	}
+	if info.ID == digest {
+		return true, nil
+	}
+	for _, d := range info.RepoDigests {
+		if strings.HasSuffix(d, "@"+digest) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// 拉取后校验,不一致时删掉刚拉取的tag
+func verifyDigest(image, tag, digest string) error {
+	if len(digest) == 0 {
+		return nil
+	}
+	ok, err := imageHasDigest(image, tag, digest)
+	if err != nil {
+		return err
+	}
+	if ok {
+		return nil
+	}
+	if err := globalClient.RemoveImage(imageRef(image, tag)); err != nil {
+		log.Errorf("remove image [%s:%s] with unexpected digest fail:%v", image, tag, err)
+	}
+	Msg := fmt.Sprintf("image %s:%s does not match digest %s, removed", image, tag, digest)
+	log.Error(Msg)
+	return errjson.NewIntegrityError(Msg)
+}
+
+// 本地已有的镜像在指定了digest时也要一致,否则重新拉取
+func localImageUsable(image, tag, digest string) (bool, error) {
+	exists, err := IsImageExist(image, tag)
+	if err != nil || !exists || len(digest) == 0 {
+		return exists, err
+	}
+	return imageHasDigest(image, tag, digest)
+}
+
+// ?digest=sha256:...
+func digestParam(r *http.Request) (string, error) {
+	digest := r.URL.Query().Get("digest")
+	if len(digest) != 0 && !validDigest(digest) {
+		return "", errjson.NewNotValidEntityError("invalid digest " + digest)
+	}
+	return digest, nil
+}
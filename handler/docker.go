@@ -0,0 +1,206 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+
+	docker "test/Godeps/_workspace/src/github.com/fsouza/go-dockerclient"
+)
+
+const DefaultDockerEndpoint = "unix:///var/run/docker.sock"
+
+// 管理的docker daemon,可以是本机的unix socket,也可以是tcp://,
+// 设置了证书时用TLS连接
+type DockerEndpoint struct {
+	Endpoint   string
+	TLSCert    string
+	TLSKey     string
+	TLSCA      string
+	APIVersion string //固定使用的API版本,daemon低于这个版本时拒绝启动
+}
+
+func newDockerClient(cfg DockerEndpoint) (*docker.Client, error) {
+	useTLS := len(cfg.TLSCert) != 0 || len(cfg.TLSKey) != 0 || len(cfg.TLSCA) != 0
+	if useTLS && strings.HasPrefix(cfg.Endpoint, "unix://") {
+		return nil, errors.New("TLS is not supported on unix socket " + cfg.Endpoint)
+	}
+	switch {
+	case useTLS && len(cfg.APIVersion) != 0:
+		return docker.NewVersionedTLSClient(cfg.Endpoint, cfg.TLSCert, cfg.TLSKey, cfg.TLSCA, cfg.APIVersion)
+	case useTLS:
+		return docker.NewTLSClient(cfg.Endpoint, cfg.TLSCert, cfg.TLSKey, cfg.TLSCA)
+	case len(cfg.APIVersion) != 0:
+		return docker.NewVersionedClient(cfg.Endpoint, cfg.APIVersion)
+	default:
+		return docker.NewClient(cfg.Endpoint)
+	}
+}
+
+func checkAPIVersion(client *docker.Client, min string) error {
+	expect, err := docker.NewAPIVersion(min)
+	if err != nil {
+		return err
+	}
+	env, err := client.Version()
+	if err != nil {
+		return err
+	}
+	actual, err := docker.NewAPIVersion(env.Get("ApiVersion"))
+	if err != nil {
+		return fmt.Errorf("invalid daemon API version %q: %v", env.Get("ApiVersion"), err)
+	}
+	if actual.LessThan(expect) {
+		return fmt.Errorf("docker daemon API %s is older than required %s", actual, expect)
+	}
+	return nil
+}
+
+var (
+	dockerEndpoint DockerEndpoint
+	dockerReady    int32
+)
+
+// 启动时调用,之后所有的docker操作都走这个daemon.只有配置错误才返回错误,
+// daemon暂时连不上时agent照常启动,由WatchEvents重连
+func ConnectDocker(cfg DockerEndpoint) error {
+	if len(cfg.Endpoint) == 0 {
+		cfg.Endpoint = DefaultDockerEndpoint
+	}
+	client, err := newDockerClient(cfg)
+	if err != nil {
+		return fmt.Errorf("create docker client for %s fail: %v", cfg.Endpoint, err)
+	}
+	dockerEndpoint = cfg
+	globalClient = &DockerClient{client, 0}
+	log.Infof("docker endpoint %s, API version [%s]", cfg.Endpoint, cfg.APIVersion)
+	if err := checkDocker(); err != nil {
+		log.Errorf("docker daemon unavailable, running degraded until it is back:%v", err)
+	}
+	return nil
+}
+
+// ping daemon并检查固定的API版本,结果记在dockerReady里
+func checkDocker() error {
+	err := globalClient.Ping()
+	if err == nil && len(dockerEndpoint.APIVersion) != 0 {
+		err = checkAPIVersion(globalClient.Client, dockerEndpoint.APIVersion)
+	}
+	if err != nil {
+		atomic.StoreInt32(&dockerReady, 0)
+		return fmt.Errorf("docker %s: %v", dockerEndpoint.Endpoint, err)
+	}
+	atomic.StoreInt32(&dockerReady, 1)
+	return nil
+}
+
+func DockerAvailable() bool {
+	return atomic.LoadInt32(&dockerReady) == 1
+}
+
+// unix socket的daemon和agent在同一台机器上,可以直接看它的数据目录和配置文件
+func DockerIsLocal() bool {
+	return strings.HasPrefix(dockerEndpoint.Endpoint, "unix://")
+}
+
+func Docker() *docker.Client {
+	return globalClient.Client
+}
+
+// go-dockerclient在unix socket上的stream请求不经过HTTPClient,也不能取消,
+// 需要超时的请求直接用这里的http client访问daemon
+func daemonHTTP() (*http.Client, string) {
+	base := "http://docker"
+	client := globalClient.HTTPClient
+	if DockerIsLocal() {
+		sock := strings.TrimPrefix(dockerEndpoint.Endpoint, "unix://")
+		client = &http.Client{Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", sock)
+			},
+		}}
+	} else {
+		scheme := "http"
+		if globalClient.TLSConfig != nil {
+			scheme = "https"
+		}
+		host := dockerEndpoint.Endpoint
+		if i := strings.Index(host, "://"); i >= 0 {
+			host = host[i+3:]
+		}
+		base = scheme + "://" + host
+	}
+	if len(dockerEndpoint.APIVersion) != 0 {
+		base += "/v" + dockerEndpoint.APIVersion
+	}
+	return client, base
+}
+
+// 和globalClient.PullImage一样,但ctx结束时断开连接,daemon那边的拉取随之取消
+func pullImageContext(ctx context.Context, repository, tag, registry string, auth docker.AuthConfiguration) error {
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(auth); err != nil {
+		return err
+	}
+	client, base := daemonHTTP()
+	query := url.Values{"fromImage": {repository}}
+	if len(tag) != 0 {
+		query.Set("tag", tag)
+	}
+	if len(registry) != 0 {
+		query.Set("registry", registry)
+	}
+	req, err := http.NewRequest("POST", base+"/images/create?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("X-Registry-Auth", base64.URLEncoding.EncodeToString(buf.Bytes()))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if strings.Contains(err.Error(), "connection refused") {
+			return docker.ErrConnectionRefused
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+		data, _ := ioutil.ReadAll(resp.Body)
+		return &docker.Error{Status: resp.StatusCode, Message: string(data)}
+	}
+
+	//拉取的进度和错误都在返回的json流里
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var m struct {
+			Error string `json:"error"`
+		}
+		if err := dec.Decode(&m); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		if len(m.Error) != 0 {
+			return errors.New(m.Error)
+		}
+	}
+}
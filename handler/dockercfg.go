@@ -0,0 +1,223 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	docker "test/Godeps/_workspace/src/github.com/fsouza/go-dockerclient"
+)
+
+const dockerHubServer = "index.docker.io"
+
+// ~/.docker/config.json 里agent关心的部分
+type dockerConfigFile struct {
+	Auths       map[string]dockerConfigAuth `json:"auths"`
+	CredsStore  string                      `json:"credsStore"`
+	CredHelpers map[string]string           `json:"credHelpers"`
+}
+
+type dockerConfigAuth struct {
+	Auth  string `json:"auth"`
+	Email string `json:"email,omitempty"`
+}
+
+// docker-credential-<helper> get 的输出
+type helperCredential struct {
+	ServerURL string `json:"ServerURL"`
+	Username  string `json:"Username"`
+	Secret    string `json:"Secret"`
+}
+
+// 本机docker客户端已有的登录信息,在/login和测试服务器下发的都没有时使用
+var dockerAuth = struct {
+	sync.RWMutex
+	configs map[string]docker.AuthConfiguration
+	store   string
+	//仓库 => helper, 以及credsStore里保存的仓库原始地址
+	helpers map[string]string
+	stored  map[string]string
+}{
+	configs: make(map[string]docker.AuthConfiguration),
+	helpers: make(map[string]string),
+	stored:  make(map[string]string),
+}
+
+// 汇报用,不含密码
+type CredentialSource struct {
+	Server string `json:"server"`
+	User   string `json:"user,omitempty"`
+	Source string `json:"source"`
+}
+
+func dockerConfigDir() string {
+	if dir := os.Getenv("DOCKER_CONFIG"); len(dir) != 0 {
+		return dir
+	}
+	return filepath.Join(os.Getenv("HOME"), ".docker")
+}
+
+func helperAvailable(name string) bool {
+	_, err := exec.LookPath("docker-credential-" + name)
+	if err != nil {
+		log.Warnf("credential helper %s not found:%v", name, err)
+		return false
+	}
+	return true
+}
+
+// 启动时读取config.json(或旧的.dockercfg)和本机可用的credential helper
+func LoadDockerConfig() error {
+	var file dockerConfigFile
+	var configs *docker.AuthConfigurations
+
+	byteContent, err := ioutil.ReadFile(filepath.Join(dockerConfigDir(), "config.json"))
+	if err == nil {
+		if err := json.Unmarshal(byteContent, &file); err != nil {
+			return err
+		}
+		//用credsStore时auths里只有空的占位,go-dockerclient解析不了
+		auths := make(map[string]dockerConfigAuth)
+		for server, a := range file.Auths {
+			if len(a.Auth) != 0 {
+				auths[server] = a
+			}
+		}
+		filtered, err := json.Marshal(map[string]interface{}{"auths": auths})
+		if err != nil {
+			return err
+		}
+		if configs, err = docker.NewAuthConfigurations(bytes.NewReader(filtered)); err != nil {
+			return err
+		}
+	} else if os.IsNotExist(err) {
+		fp, err := os.Open(filepath.Join(os.Getenv("HOME"), ".dockercfg"))
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		configs, err = docker.NewAuthConfigurations(fp)
+		fp.Close()
+		if err != nil {
+			return err
+		}
+	} else {
+		return err
+	}
+
+	dockerAuth.Lock()
+	defer dockerAuth.Unlock()
+	for server, conf := range configs.Configs {
+		dockerAuth.configs[normalizeServer(server)] = conf
+	}
+	for server, helper := range file.CredHelpers {
+		if helperAvailable(helper) {
+			dockerAuth.helpers[normalizeServer(server)] = helper
+		}
+	}
+	if len(file.CredsStore) != 0 && helperAvailable(file.CredsStore) {
+		dockerAuth.store = file.CredsStore
+		servers, err := helperList(file.CredsStore)
+		if err != nil {
+			log.Warnf("list credentials of %s fail:%v", file.CredsStore, err)
+		}
+		for server := range servers {
+			dockerAuth.stored[normalizeServer(server)] = server
+		}
+	}
+	log.Infof("docker config: %d auth(s), %d helper(s), credsStore[%s]", len(dockerAuth.configs), len(dockerAuth.helpers), dockerAuth.store)
+	return nil
+}
+
+func runHelper(helper string, action string, input string) ([]byte, error) {
+	cmd := exec.Command("docker-credential-"+helper, action)
+	cmd.Stdin = strings.NewReader(input)
+	return cmd.Output()
+}
+
+// 返回 仓库地址 => 用户名
+func helperList(helper string) (map[string]string, error) {
+	out, err := runHelper(helper, "list", "")
+	if err != nil {
+		return nil, err
+	}
+	servers := make(map[string]string)
+	err = json.Unmarshal(out, &servers)
+	return servers, err
+}
+
+func helperGet(helper string, server string) (docker.AuthConfiguration, bool) {
+	out, err := runHelper(helper, "get", server)
+	if err != nil {
+		log.Warnf("get credentials of %s from %s fail:%v", server, helper, err)
+		return docker.AuthConfiguration{}, false
+	}
+	var c helperCredential
+	if err := json.Unmarshal(out, &c); err != nil {
+		log.Warnf("invalid output of credential helper %s:%v", helper, err)
+		return docker.AuthConfiguration{}, false
+	}
+	//identity token这个版本的docker API不支持
+	if c.Username == "<token>" {
+		return docker.AuthConfiguration{}, false
+	}
+	return docker.AuthConfiguration{Username: c.Username, Password: c.Secret, ServerAddress: server}, true
+}
+
+func dockerFallback(server string) (docker.AuthConfiguration, bool) {
+	server = normalizeServer(server)
+	dockerAuth.RLock()
+	conf, ok := dockerAuth.configs[server]
+	helper, hasHelper := dockerAuth.helpers[server]
+	store := dockerAuth.store
+	stored, inStore := dockerAuth.stored[server]
+	dockerAuth.RUnlock()
+
+	if ok {
+		return conf, true
+	}
+	if hasHelper {
+		return helperGet(helper, server)
+	}
+	if inStore {
+		return helperGet(store, stored)
+	}
+	return docker.AuthConfiguration{}, false
+}
+
+func credentialSources() []CredentialSource {
+	var list []CredentialSource
+
+	creds.RLock()
+	for server, info := range creds.entries {
+		list = append(list, CredentialSource{Server: server, User: info.User, Source: "agent"})
+	}
+	creds.RUnlock()
+
+	dockerAuth.RLock()
+	for server, conf := range dockerAuth.configs {
+		list = append(list, CredentialSource{Server: server, User: conf.Username, Source: "dockercfg"})
+	}
+	for server, helper := range dockerAuth.helpers {
+		list = append(list, CredentialSource{Server: server, Source: "helper:" + helper})
+	}
+	for server := range dockerAuth.stored {
+		list = append(list, CredentialSource{Server: server, Source: "helper:" + dockerAuth.store})
+	}
+	dockerAuth.RUnlock()
+
+	sort.SliceStable(list, func(i, j int) bool { return list[i].Server < list[j].Server })
+	return list
+}
+
+func ListCredentials(w http.ResponseWriter, r *http.Request) error {
+	return writeJSON(w, r, credentialSources())
+}
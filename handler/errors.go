@@ -0,0 +1,70 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"test/errjson"
+
+	docker "test/Godeps/_workspace/src/github.com/fsouza/go-dockerclient"
+)
+
+// 把handler和go-dockerclient返回的错误转换成errjson的类型
+func toRespError(err error) errjson.RespError {
+	switch e := err.(type) {
+	case errjson.Responder:
+		return e.Response()
+	case notfound:
+		return errjson.NewNotFoundError(e.Error()).RespError
+	case *docker.NoSuchContainer:
+		return errjson.NewNotFoundError(e.Error()).RespError
+	case *docker.ContainerAlreadyRunning:
+		return errjson.NewConflictError(e.Error()).RespError
+	case *docker.ContainerNotRunning:
+		return errjson.NewConflictError(e.Error()).RespError
+	case *http.MaxBytesError:
+		return errjson.NewRequestEntityTooLargeError(fmt.Sprintf("request body exceeds %d bytes", e.Limit)).RespError
+	case *docker.Error:
+		switch e.Status {
+		case http.StatusNotFound:
+			return errjson.NewNotFoundError(e.Message).RespError
+		case http.StatusUnauthorized:
+			return errjson.NewUnauthorizedError(e.Message).RespError
+		case http.StatusForbidden:
+			return errjson.NewErrForbidden(e.Message).RespError
+		case http.StatusConflict:
+			return errjson.NewConflictError(e.Message).RespError
+		case http.StatusServiceUnavailable:
+			return errjson.NewServiceUnavailableError(e.Message).RespError
+		}
+		return errjson.NewInternalServerError(e.Message).RespError
+	}
+
+	switch err {
+	case docker.ErrNoSuchImage:
+		return errjson.NewNotFoundError(err.Error()).RespError
+	case docker.ErrConnectionRefused:
+		return errjson.NewServiceUnavailableError("docker daemon unavailable: " + err.Error()).RespError
+	}
+	return errjson.NewInternalServerError(err.Error()).RespError
+}
+
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	resp := toRespError(err)
+	if resp.Status >= 500 {
+		log.Error(err)
+	} else {
+		log.Warn(err)
+	}
+	if isV1(r) {
+		e := newEnvelope(r, nil)
+		e.Error = &resp
+		writeEnvelope(w, resp.Status, e)
+		return
+	}
+	byteContent, _ := json.Marshal(resp)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(resp.Status)
+	w.Write(byteContent)
+}
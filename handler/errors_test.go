@@ -0,0 +1,34 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"test/errjson"
+
+	docker "test/Godeps/_workspace/src/github.com/fsouza/go-dockerclient"
+)
+
+func TestToRespError(t *testing.T) {
+	cases := []struct {
+		err    error
+		status int
+	}{
+		{errjson.NewNotValidEntityError("x"), http.StatusUnprocessableEntity},
+		{notfound{}, http.StatusNotFound},
+		{docker.ErrNoSuchImage, http.StatusNotFound},
+		{docker.ErrConnectionRefused, http.StatusServiceUnavailable},
+		{&docker.NoSuchContainer{ID: "c"}, http.StatusNotFound},
+		{&docker.Error{Status: http.StatusNotFound, Message: "manifest unknown"}, http.StatusNotFound},
+		{&docker.Error{Status: http.StatusUnauthorized, Message: "authentication required"}, http.StatusUnauthorized},
+		{&docker.Error{Status: http.StatusInternalServerError, Message: "boom"}, http.StatusInternalServerError},
+		{&http.MaxBytesError{Limit: 10}, http.StatusRequestEntityTooLarge},
+		{errors.New("other"), http.StatusInternalServerError},
+	}
+	for _, c := range cases {
+		if got := toRespError(c.err).Status; got != c.status {
+			t.Errorf("%T %v: status %d, want %d", c.err, c.err, got, c.status)
+		}
+	}
+}
@@ -0,0 +1,252 @@
+package handler
+
+import (
+	"strconv"
+	"time"
+
+	docker "test/Godeps/_workspace/src/github.com/fsouza/go-dockerclient"
+)
+
+const (
+	eventRetryInterval = 3 * time.Second
+	eventQueueSize     = 256
+	eventBacklogSize   = 1024
+)
+
+// 转发给测试服务器的事件
+type Event struct {
+	Type     string `json:"type"`
+	Action   string `json:"action"`
+	ID       string `json:"id"`
+	From     string `json:"from,omitempty"`
+	RunID    string `json:"run_id,omitempty"`
+	Attempt  int    `json:"attempt,omitempty"`
+	State    string `json:"state,omitempty"`
+	ExitCode int    `json:"exit_code"`
+	Time     int64  `json:"time"`
+}
+
+var (
+	eventForwarder func(Event) error
+	eventQueue     = make(chan Event, eventQueueSize)
+)
+
+func SetEventForwarder(fn func(Event) error) {
+	eventForwarder = fn
+}
+
+// docker daemon重启后事件流会断开,这里负责重连并对账
+func WatchEvents() {
+	go forwardEvents()
+
+	for {
+		if err := checkDocker(); err != nil {
+			log.Errorf("docker daemon unreachable:%v", err)
+			time.Sleep(eventRetryInterval)
+			continue
+		}
+
+		listener := make(chan *docker.APIEvents, eventQueueSize)
+		if err := globalClient.AddEventListener(listener); err != nil {
+			log.Errorf("add docker event listener fail:%v", err)
+			time.Sleep(eventRetryInterval)
+			continue
+		}
+		log.Info("watching docker events")
+
+		//断开期间错过的事件,通过检查容器状态补上
+		resyncRuns()
+
+		for ev := range listener {
+			handleEvent(ev)
+		}
+		log.Warn("docker event stream closed, reconnecting")
+		time.Sleep(eventRetryInterval)
+	}
+}
+
+func handleEvent(ev *docker.APIEvents) {
+	if ev == nil {
+		return
+	}
+	switch ev.Type {
+	case "container":
+		handleContainerEvent(ev)
+	case "image":
+		if ev.Action == "delete" {
+			log.Infof("image [%s] deleted", ev.ID)
+			publishEvent(Event{Type: ev.Type, Action: ev.Action, ID: ev.ID, Time: ev.Time})
+		}
+	}
+}
+
+func handleContainerEvent(ev *docker.APIEvents) {
+	switch ev.Action {
+	case "start", "die", "oom", "kill", "destroy":
+	default:
+		return
+	}
+
+	//旧版本API的die事件不带exitCode,需要inspect
+	exitCode := 0
+	if ev.Action == "die" {
+		if code, ok := ev.Actor.Attributes["exitCode"]; ok {
+			exitCode, _ = strconv.Atoi(code)
+		} else if container, err := globalClient.InspectContainer(ev.ID); err == nil {
+			exitCode = container.State.ExitCode
+		}
+	}
+
+	runs.Lock()
+	run, ok := runs.byContainer[ev.ID]
+	if !ok {
+		runs.Unlock()
+		return
+	}
+	job := run.job(ev.ID)
+	wasTerminal := isTerminal(job.State)
+	at := time.Unix(ev.Time, 0)
+
+	switch ev.Action {
+	case "start":
+		job.State = RunRunning
+		job.StartedAt = at
+	case "oom":
+		job.OOMKilled = true
+	case "kill":
+		job.Killed = true
+	case "die":
+		if wasTerminal {
+			break
+		}
+		job.ExitCode = exitCode
+		job.FinishedAt = at
+		job.State = exitState(job)
+	case "destroy":
+		job.Removed = true
+		if !isTerminal(job.State) {
+			job.State = RunLost
+		}
+		delete(runs.byContainer, ev.ID)
+	}
+	if job.State == RunRunning {
+		run.State = RunRunning
+	}
+	finished := !wasTerminal && isTerminal(job.State)
+	e := Event{
+		Type:     ev.Type,
+		Action:   ev.Action,
+		ID:       ev.ID,
+		From:     ev.From,
+		RunID:    run.ID,
+		Attempt:  job.Attempt,
+		State:    job.State,
+		ExitCode: job.ExitCode,
+		Time:     ev.Time,
+	}
+	runs.Unlock()
+
+	log.Debugf("run[%s]: attempt %d container [%s] %s => %s", e.RunID, e.Attempt, ev.ID, ev.Action, e.State)
+	publishEvent(e)
+
+	//收集日志和产物后,决定是否重试
+	if finished {
+		go finishAttempt(run, job)
+	}
+}
+
+func exitState(job *Job) string {
+	switch {
+	case job.OOMKilled:
+		return RunOOM
+	case job.Killed && job.ExitCode != 0:
+		return RunKilled
+	case job.ExitCode == 0:
+		return RunSucceeded
+	}
+	return RunFailed
+}
+
+// 重连后根据容器的真实状态修正run
+func resyncRuns() {
+	runs.RLock()
+	ids := make([]string, 0, len(runs.byContainer))
+	for id, run := range runs.byContainer {
+		if !isTerminal(run.job(id).State) {
+			ids = append(ids, id)
+		}
+	}
+	runs.RUnlock()
+
+	for _, id := range ids {
+		container, err := globalClient.InspectContainer(id)
+		if err != nil {
+			if _, ok := err.(*docker.NoSuchContainer); ok {
+				handleContainerEvent(&docker.APIEvents{Type: "container", Action: "destroy", ID: id, Time: time.Now().Unix()})
+				continue
+			}
+			log.Errorf("resync container [%s] fail:%v", id, err)
+			continue
+		}
+
+		state := container.State
+		switch {
+		case state.Running:
+			handleContainerEvent(&docker.APIEvents{Type: "container", Action: "start", ID: id, Time: state.StartedAt.Unix()})
+		case !state.FinishedAt.IsZero():
+			if state.OOMKilled {
+				handleContainerEvent(&docker.APIEvents{Type: "container", Action: "oom", ID: id, Time: state.FinishedAt.Unix()})
+			}
+			handleContainerEvent(&docker.APIEvents{
+				Type:   "container",
+				Action: "die",
+				ID:     id,
+				Time:   state.FinishedAt.Unix(),
+				Actor:  docker.APIActor{Attributes: map[string]string{"exitCode": strconv.Itoa(state.ExitCode)}},
+			})
+		}
+	}
+}
+
+func publishEvent(e Event) {
+	if eventForwarder == nil {
+		return
+	}
+	select {
+	case eventQueue <- e:
+	default:
+		log.Warnf("event queue full, drop event %s:%s [%s]", e.Type, e.Action, e.ID)
+	}
+}
+
+// 与服务器失联期间事件先积压,重新上线后按顺序补发;
+// 在线时转发失败,积压不为空就定时重试,不用等下一个事件
+func forwardEvents() {
+	var backlog []Event
+
+	for {
+		var retryC <-chan time.Time
+		if len(backlog) > 0 {
+			retryC = time.After(eventRetryInterval)
+		}
+		select {
+		case e := <-eventQueue:
+			backlog = append(backlog, e)
+			if len(backlog) > eventBacklogSize {
+				log.Warnf("event backlog full, drop event %s:%s [%s]", backlog[0].Type, backlog[0].Action, backlog[0].ID)
+				backlog = backlog[1:]
+			}
+		case <-resumeC:
+		case <-retryC:
+		}
+
+		for len(backlog) > 0 && Mode() == ModeOnline {
+			e := backlog[0]
+			if err := eventForwarder(e); err != nil {
+				log.Errorf("forward event %s:%s [%s] fail:%v", e.Type, e.Action, e.ID, err)
+				break
+			}
+			backlog = backlog[1:]
+		}
+	}
+}
@@ -2,7 +2,6 @@ package handler
 
 import (
 	"encoding/json"
-	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -18,11 +17,8 @@ import (
 
 var (
 	globalClient *DockerClient
-	//在服务器启动后,询问上级服务器获取registry的地址
-	globalRegistry string
-	log            = logrus.New()
-	ui             = new(UserInfo)
-	logFile        = "./test.log"
+	log          = logrus.New()
+	logFile      = "./test.log"
 )
 
 type DockerClient struct {
@@ -30,8 +26,11 @@ type DockerClient struct {
 	State int
 }
 
+//在服务器启动后,询问上级服务器获取registry的地址
 func SetRegistry(registry string) {
-	globalRegistry = registry
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	registries.Primary.Address = registry
 }
 
 //配合negroni,并且封装handler error
@@ -39,8 +38,7 @@ type JsonReturnHandler func(http.ResponseWriter, *http.Request) error
 
 func (fn JsonReturnHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if err := fn(w, r); err != nil {
-		log.Error(err)
-		http.Error(w, err.Error(), 500)
+		writeError(w, r, err)
 	}
 }
 
@@ -101,15 +99,12 @@ func ListImages(w http.ResponseWriter, r *http.Request) error {
 			imagelist = append(imagelist, *newImage)
 		}
 	}
-	byteContent, err := json.Marshal(imagelist)
-	if err != nil {
-		log.Errorf("ListImages:%v\n", err)
-		return err
+	//v1没有镜像时返回[]而不是null
+	if imagelist == nil && isV1(r) {
+		imagelist = []ImageList{}
 	}
-
-	fmt.Fprintf(w, string(byteContent))
 	log.Debugf("ListImages:success\n")
-	return nil
+	return writeJSON(w, r, imagelist)
 }
 
 func PublicPullImage(w http.ResponseWriter, r *http.Request) error {
@@ -118,53 +113,79 @@ func PublicPullImage(w http.ResponseWriter, r *http.Request) error {
 	tag := vars["tag"]
 
 	if len(image) == 0 || len(tag) == 0 {
-		return errors.New("invalid argument")
+		return errjson.NewNotValidEntityError("invalid argument")
+	}
+	if err := beginWork(); err != nil {
+		return err
+	}
+	defer endWork()
+	if err := checkImagePolicy(image); err != nil {
+		return err
+	}
+	digest, err := digestParam(r)
+	if err != nil {
+		return err
 	}
 
-	exists, err := IsImageExist(image, tag)
+	exists, err := localImageUsable(image, tag, digest)
 	if err != nil {
 		log.Errorf("pushFromPublic check image[%s:%s] exists fail:%v\n", image, tag, err)
-		return errjson.NewInternalServerError(err.Error())
+		return err
 	}
 
+	//本地已有的镜像也要检查大小,但不删除
 	if exists {
-		return nil
+		return checkImageSize(image, tag, false)
 	}
 
-	slice := strings.SplitN(image, "/", 2)
-	registry := slice[0]
-	repo := slice[1]
+	//镜像名里不一定带仓库地址
+	registry := registryOf(image)
 
 	opts := docker.PullImageOptions{
-		Repository: repo,
+		Repository: image,
 		Tag:        tag,
 		Registry:   registry,
 	}
-	auths := docker.AuthConfiguration{}
-	err = globalClient.PullImage(opts, auths)
+	err = globalClient.PullImage(opts, credentialsFor(registry))
 	if err != nil {
 		log.Errorf("pushFromPublic: pull image[%s:%s] fail:%v\n", image, tag, err)
 		return err
 	}
+	if err := checkImageSize(image, tag, true); err != nil {
+		return err
+	}
+	if err := verifyDigest(image, tag, digest); err != nil {
+		return err
+	}
 	log.Debugf("pushFromPublic success")
 	return nil
 }
 
 type TagOpt struct {
-	New string `json:"new"`
-	Old string `json:"old"`
+	New string `json:"new" validate:"required"`
+	Old string `json:"old" validate:"required"`
 }
 
 func TagImage(w http.ResponseWriter, r *http.Request) error {
 	var tagOpt TagOpt
 
+	if err := beginWork(); err != nil {
+		return err
+	}
+	defer endWork()
+
 	byteContent, err := ioutil.ReadAll(r.Body)
 	defer r.Body.Close()
 	if err != nil {
 		return err
 	}
 
-	json.Unmarshal(byteContent, &tagOpt)
+	if err := json.Unmarshal(byteContent, &tagOpt); err != nil {
+		return errjson.NewNotValidEntityError(err.Error())
+	}
+	if len(tagOpt.Old) == 0 || len(tagOpt.New) == 0 {
+		return errjson.NewNotValidEntityError("old and new are required")
+	}
 	old := tagOpt.Old
 	new := tagOpt.New
 
@@ -188,13 +209,13 @@ func TagImage(w http.ResponseWriter, r *http.Request) error {
 	exists, err := IsImageExist(image1, tag1)
 	if err != nil {
 		log.Errorf("[%s:%s] get Image exist check fail:%v \n", image1, tag1, err)
-		return errjson.NewInternalServerError(err.Error())
+		return err
 	}
 
 	if !exists {
-		Msg := fmt.Sprintf("image[%s] doesn't exists\n", old)
-		log.Errorf(Msg)
-		return errors.New(Msg)
+		Msg := fmt.Sprintf("image[%s] doesn't exists", old)
+		log.Error(Msg)
+		return errjson.NewNotFoundError(Msg)
 	}
 
 	opts := docker.TagImageOptions{
@@ -221,14 +242,17 @@ func CheckExists(w http.ResponseWriter, r *http.Request) error {
 	tag := vars["tag"]
 
 	if len(image) == 0 || len(tag) == 0 {
-		return errors.New("invalid argument")
+		return errjson.NewNotValidEntityError("invalid argument")
 	}
 	exists, err := IsImageExist(image, tag)
 	if err != nil {
 		log.Errorf("PullImage check image [%s:%s] exists fail:%v\n", image, tag, err)
-		return errjson.NewInternalServerError(err.Error())
+		return err
 	}
 
+	if isV1(r) {
+		return writeJSON(w, r, ImageExists{Image: imageRef(image, tag), Exists: exists})
+	}
 	if exists {
 		fmt.Fprintf(w, "exists")
 	} else {
@@ -237,9 +261,14 @@ func CheckExists(w http.ResponseWriter, r *http.Request) error {
 	return nil
 }
 
+type ImageExists struct {
+	Image  string `json:"image"`
+	Exists bool   `json:"exists"`
+}
+
 type UserInfo struct {
-	User     string `json:"user"`
-	Password string `json:"password"`
+	User     string `json:"user" validate:"required"`
+	Password string `json:"password" validate:"required"`
 	Server   string `json:"server"`
 }
 
@@ -255,15 +284,26 @@ func Login(w http.ResponseWriter, r *http.Request) error {
 		}
 	}()
 
-	err = json.Unmarshal(byteContent, &ui)
+	var info UserInfo
+	err = json.Unmarshal(byteContent, &info)
 	if err != nil {
-		return err
+		return errjson.NewNotValidEntityError(err.Error())
+	}
+	if len(info.User) == 0 || len(info.Password) == 0 {
+		return errjson.NewNotValidEntityError("user and password are required")
+	}
+	if len(info.Server) == 0 {
+		info.Server = Registries().Primary.Address
 	}
 
-	log.Debugf("user: %s\n", ui.User)
-	log.Debugf("Password: %s\n", ui.Password)
-	log.Debugf("server: %s\n", ui.Server)
-
+	if err := checkCredentials(info); err != nil {
+		log.Warnf("login %s fail:%v", info, err)
+		return errjson.NewUnauthorizedError("login " + info.Server + " fail: " + err.Error())
+	}
+	if err := creds.set(info); err != nil {
+		return err
+	}
+	log.Infof("login %s success", info)
 	return nil
 }
 
@@ -273,20 +313,18 @@ func PullImage(w http.ResponseWriter, r *http.Request) error {
 	tag := vars["tag"]
 
 	if len(image) == 0 || len(tag) == 0 {
-		return errors.New("invalid argument")
+		return errjson.NewNotValidEntityError("invalid argument")
 	}
-
-	opts := docker.PullImageOptions{
-		Repository: image,
-		Tag:        tag,
-		Registry:   globalRegistry,
+	if err := beginWork(); err != nil {
+		return err
 	}
-	auths := docker.AuthConfiguration{
-		Username:      ui.User,
-		Password:      ui.Password,
-		ServerAddress: ui.Server,
+	defer endWork()
+	digest, err := digestParam(r)
+	if err != nil {
+		return err
 	}
-	err := globalClient.PullImage(opts, auths)
+
+	err = pullImage(image, tag, digest)
 	if err != nil {
 		t := reflect.TypeOf(err)
 		log.Errorf("PullImage:[%s:%s] ErrType:[%s:%s] fail:%v\n", image, tag, t.Name(), t.String(), err)
@@ -303,8 +341,12 @@ func PushImage(w http.ResponseWriter, r *http.Request) error {
 	tag := vars["tag"]
 
 	if len(image) == 0 || len(tag) == 0 {
-		return errors.New("invalid argument")
+		return errjson.NewNotValidEntityError("invalid argument")
+	}
+	if err := beginWork(); err != nil {
+		return err
 	}
+	defer endWork()
 	log.Debugf("pushImage:[%s:%s]\n", image, tag)
 
 	exists, err := IsImageExist(image, tag)
@@ -315,7 +357,7 @@ func PushImage(w http.ResponseWriter, r *http.Request) error {
 
 	if !exists {
 		Msg := fmt.Sprintf("%v:%v doesn't exist", image, tag)
-		log.Errorf(Msg)
+		log.Error(Msg)
 		return errjson.NewErrForbidden(Msg)
 	}
 
@@ -323,16 +365,11 @@ func PushImage(w http.ResponseWriter, r *http.Request) error {
 		Name: image,
 		Tag:  tag,
 	}
-	auth := docker.AuthConfiguration{
-		Username:      ui.User,
-		Password:      ui.Password,
-		ServerAddress: ui.Server,
-	}
-	err = globalClient.PushImage(opts, auth)
+	err = globalClient.PushImage(opts, authForImage(image))
 	if err != nil {
 		t := reflect.TypeOf(err)
 		log.Errorf("pushImage:[%s:%s] ErrType:[%v:%v] fail:%v\n", image, tag, t.Name(), t.String(), err)
-		return errjson.NewInternalServerError(err.Error())
+		return err
 	}
 
 	log.Debugf("pushImage [%s:%s] success", image, tag)
@@ -358,12 +395,6 @@ func RemoveImage(http.ResponseWriter, *http.Request) error {
 }
 
 //这里需要设置私有仓库地址,重启docker daemon, 在agent启动时,就要配置好
-
-func Shutdown(http.ResponseWriter, *http.Request) {
-	log.Info("recieve server's shutdown command")
-	os.Exit(0)
-}
-
 func init() {
 
 	log.Level = logrus.DebugLevel
@@ -374,12 +405,4 @@ func init() {
 		os.Exit(1)
 	}
 	log.Out = fp
-
-	endpoint := "unix://var/run/docker.sock"
-	client, err := docker.NewClient(endpoint)
-	if err != nil {
-		panic(err)
-	}
-	globalClient = &DockerClient{client, 0}
-
 }
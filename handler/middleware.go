@@ -0,0 +1,261 @@
+package handler
+
+import (
+	stdcontext "context"
+	"fmt"
+	"net/http"
+	"os"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"test/errjson"
+
+	"test/Godeps/_workspace/src/github.com/Sirupsen/logrus"
+	"test/Godeps/_workspace/src/github.com/gorilla/context"
+)
+
+const DefaultMaxBodySize = 1 << 20
+
+// 访问日志,默认和handler的日志在一起
+var accessLog = log
+
+type Middleware func(http.Handler) http.Handler
+
+// 第一个在最外层
+func Chain(h http.Handler, middlewares ...Middleware) http.Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		h = middlewares[i](h)
+	}
+	return h
+}
+
+// 访问日志单独写到path,每行一个JSON
+func SetAccessLog(path string) error {
+	fp, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	l := logrus.New()
+	l.Out = fp
+	l.Formatter = &logrus.JSONFormatter{}
+	l.Level = logrus.InfoLevel
+	accessLog = l
+	return nil
+}
+
+// 每个请求都带上ID,调用方给了X-Request-Id时沿用
+func RequestIDs(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		setRequestID(w, r)
+		h.ServeHTTP(w, r)
+	})
+}
+
+func AccessLog(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		h.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+
+		entry := accessLog.WithFields(logrus.Fields{
+			"request_id":  RequestID(r),
+			"method":      r.Method,
+			"path":        r.URL.Path,
+			"status":      rec.status,
+			"bytes":       rec.bytes,
+			"duration_ms": int64(time.Since(start) / time.Millisecond),
+			"remote_addr": r.RemoteAddr,
+			"caller":      Caller(r),
+		})
+		switch {
+		case rec.status >= 500:
+			entry.Error("request")
+		case rec.status >= 400:
+			entry.Warn("request")
+		default:
+			entry.Info("request")
+		}
+	})
+}
+
+// Timeout里handler所在的goroutine panic时,带上原来的调用栈交给Recover
+type handlerPanic struct {
+	value interface{}
+	stack []byte
+}
+
+func logPanic(r *http.Request, hp *handlerPanic) {
+	log.WithFields(logrus.Fields{
+		"request_id": RequestID(r),
+		"method":     r.Method,
+		"path":       r.URL.Path,
+	}).Errorf("panic: %v\n%s", hp.value, hp.stack)
+}
+
+// handler panic时返回500,不让一个请求拖垮整个agent和正在跑的测试
+func Recover(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w}
+		defer func() {
+			p := recover()
+			if p == nil {
+				return
+			}
+			//net/http用来中断连接的panic,原样抛出
+			if p == http.ErrAbortHandler {
+				panic(p)
+			}
+			hp, ok := p.(*handlerPanic)
+			if !ok {
+				hp = &handlerPanic{value: p, stack: debug.Stack()}
+			}
+			logPanic(r, hp)
+			//已经开始输出,只能断开
+			if rec.status != 0 {
+				return
+			}
+			writeError(rec, r, errjson.NewInternalServerError("internal error, request "+RequestID(r)))
+		}()
+		h.ServeHTTP(rec, r)
+	})
+}
+
+// n<=0表示不限制
+func LimitBody(n int64) Middleware {
+	return func(h http.Handler) http.Handler {
+		if n <= 0 {
+			return h
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.ContentLength > n {
+				writeError(w, r, errjson.NewRequestEntityTooLargeError(fmt.Sprintf("request body exceeds %d bytes", n)))
+				return
+			}
+			if r.Body != nil {
+				r.Body = http.MaxBytesReader(w, r.Body, n)
+			}
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
+// 超时前handler的输出先缓存,超时后丢弃
+type timeoutWriter struct {
+	sync.Mutex
+	header   http.Header
+	status   int
+	body     []byte
+	timedOut bool
+}
+
+func (tw *timeoutWriter) Header() http.Header {
+	return tw.header
+}
+
+func (tw *timeoutWriter) WriteHeader(status int) {
+	tw.Lock()
+	defer tw.Unlock()
+	if tw.status == 0 {
+		tw.status = status
+	}
+}
+
+func (tw *timeoutWriter) Write(b []byte) (int, error) {
+	tw.Lock()
+	defer tw.Unlock()
+	if tw.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	if tw.status == 0 {
+		tw.status = http.StatusOK
+	}
+	tw.body = append(tw.body, b...)
+	return len(b), nil
+}
+
+func (tw *timeoutWriter) flushTo(w http.ResponseWriter) {
+	tw.Lock()
+	defer tw.Unlock()
+	for k, v := range tw.header {
+		w.Header()[k] = v
+	}
+	//handler没有输出时保持原样,由V1补上Envelope
+	if tw.status != 0 {
+		w.WriteHeader(tw.status)
+	}
+	if len(tw.body) != 0 {
+		w.Write(tw.body)
+	}
+}
+
+// r.WithContext会生成新的*http.Request,gorilla context里的值(路径参数、请求ID等)要一起带过去
+func withContext(r *http.Request, ctx stdcontext.Context) *http.Request {
+	r2 := r.WithContext(ctx)
+	for k, v := range context.GetAll(r) {
+		context.Set(r2, k, v)
+	}
+	return r2
+}
+
+// d<=0表示不限制;超时返回503,handler的goroutine继续跑完,可以通过r.Context()提前结束
+func Timeout(d time.Duration) Middleware {
+	return func(h http.Handler) http.Handler {
+		if d <= 0 {
+			return h
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx, cancel := stdcontext.WithTimeout(r.Context(), d)
+			defer cancel()
+			r2 := withContext(r, ctx)
+			tw := &timeoutWriter{header: make(http.Header)}
+			done := make(chan map[interface{}]interface{}, 1)
+			panicked := make(chan *handlerPanic, 1)
+			go func() {
+				defer context.Clear(r2)
+				defer func() {
+					p := recover()
+					if p == nil {
+						done <- context.GetAll(r2)
+						return
+					}
+					hp := &handlerPanic{value: p, stack: debug.Stack()}
+					tw.Lock()
+					defer tw.Unlock()
+					//已经超时返回,没有人再等panicked,在这里记下来
+					if tw.timedOut {
+						logPanic(r2, hp)
+						return
+					}
+					panicked <- hp
+				}()
+				h.ServeHTTP(tw, r2)
+			}()
+
+			select {
+			case p := <-panicked:
+				panic(p)
+			case values := <-done:
+				//认证等中间件设置的值,访问日志还要用
+				for k, v := range values {
+					context.Set(r, k, v)
+				}
+				tw.flushTo(w)
+			case <-ctx.Done():
+				tw.Lock()
+				tw.timedOut = true
+				tw.Unlock()
+				//超时的同时handler panic了
+				select {
+				case hp := <-panicked:
+					logPanic(r, hp)
+				default:
+				}
+				writeError(w, r, errjson.NewServiceUnavailableError(fmt.Sprintf("request timed out after %v", d)))
+			}
+		})
+	}
+}
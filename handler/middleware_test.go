@@ -0,0 +1,91 @@
+package handler
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"test/errjson"
+)
+
+func v1Chain(h http.Handler, timeout time.Duration, maxBody int64) http.Handler {
+	return Chain(h, RequestIDs, AccessLog, Recover, V1, LimitBody(maxBody), Timeout(timeout))
+}
+
+func TestMiddlewareChain(t *testing.T) {
+	cases := []struct {
+		name    string
+		h       http.HandlerFunc
+		body    string
+		timeout time.Duration
+		status  int
+		data    bool
+	}{
+		{"no output", func(w http.ResponseWriter, r *http.Request) {}, "", time.Second, http.StatusOK, false},
+		{"status only", func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusAccepted) }, "", time.Second, http.StatusAccepted, false},
+		{"data", func(w http.ResponseWriter, r *http.Request) { writeJSON(w, r, []string{"a"}) }, "", time.Second, http.StatusOK, true},
+		{"error", JsonReturnHandler(func(w http.ResponseWriter, r *http.Request) error { return errjson.NewNotFoundError("x") }).ServeHTTP, "", time.Second, http.StatusNotFound, false},
+		{"panic", func(w http.ResponseWriter, r *http.Request) { panic("boom") }, "", time.Second, http.StatusInternalServerError, false},
+		{"timeout", func(w http.ResponseWriter, r *http.Request) { <-r.Context().Done() }, "", 50 * time.Millisecond, http.StatusServiceUnavailable, false},
+		{"body too large", JsonReturnHandler(func(w http.ResponseWriter, r *http.Request) error {
+			_, err := ioutil.ReadAll(r.Body)
+			return err
+		}).ServeHTTP, strings.Repeat("a", 100), time.Second, http.StatusRequestEntityTooLarge, false},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest("POST", "/v1/x", ioutil.NopCloser(strings.NewReader(c.body)))
+		req.ContentLength = -1
+		rr := httptest.NewRecorder()
+		v1Chain(c.h, c.timeout, 10).ServeHTTP(rr, req)
+
+		if rr.Code != c.status {
+			t.Errorf("%s: status %d, want %d", c.name, rr.Code, c.status)
+		}
+		var e Envelope
+		if err := json.Unmarshal(rr.Body.Bytes(), &e); err != nil {
+			t.Errorf("%s: body %q is not an envelope", c.name, rr.Body.String())
+			continue
+		}
+		if (e.Error != nil) != (c.status >= 400) {
+			t.Errorf("%s: error %v for status %d", c.name, e.Error, c.status)
+		}
+		if (e.Data != nil) != c.data {
+			t.Errorf("%s: data %v", c.name, e.Data)
+		}
+		if len(e.RequestID) == 0 || e.RequestID != rr.Header().Get(RequestIDHeader) {
+			t.Errorf("%s: request id %q, header %q", c.name, e.RequestID, rr.Header().Get(RequestIDHeader))
+		}
+	}
+}
+
+func TestLimitBodyContentLength(t *testing.T) {
+	req := httptest.NewRequest("POST", "/x", strings.NewReader(strings.Repeat("a", 100)))
+	rr := httptest.NewRecorder()
+	called := false
+	LimitBody(10)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { called = true })).ServeHTTP(rr, req)
+	if called || rr.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("called %v, status %d", called, rr.Code)
+	}
+}
+
+// 超时后handler再panic,不能丢也不能让进程退出
+func TestTimeoutLatePanic(t *testing.T) {
+	release := make(chan struct{})
+	finished := make(chan struct{})
+	h := Timeout(20 * time.Millisecond)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer close(finished)
+		<-release
+		panic("late")
+	}))
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest("GET", "/x", nil))
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("status %d, want 503", rr.Code)
+	}
+	close(release)
+	<-finished
+}
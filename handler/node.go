@@ -0,0 +1,107 @@
+package handler
+
+import (
+	"net"
+	"os"
+	"runtime"
+	"syscall"
+
+	docker "test/Godeps/_workspace/src/github.com/fsouza/go-dockerclient"
+)
+
+type DiskInfo struct {
+	Path  string `json:"path"`
+	Total uint64 `json:"total"`
+	Free  uint64 `json:"free"`
+}
+
+// 注册时上报给测试服务器的节点信息
+type NodeInfo struct {
+	NodeID        string             `json:"node_id"`
+	Version       string             `json:"version"`
+	Hostname      string             `json:"hostname"`
+	IPs           []string           `json:"ips"`
+	ListenPort    string             `json:"listen_port"`
+	Reverse       bool               `json:"reverse"`
+	CPU           int                `json:"cpu"`
+	Memory        int64              `json:"memory"`
+	Disk          DiskInfo           `json:"disk"`
+	Labels        map[string]string  `json:"labels"`
+	DockerVersion map[string]string  `json:"docker_version"`
+	DockerInfo    *docker.DockerInfo `json:"docker_info"`
+	Images        []string           `json:"images"`
+}
+
+func CollectNodeInfo(listenPort string, labels map[string]string) (*NodeInfo, error) {
+	node := &NodeInfo{
+		ListenPort: listenPort,
+		Labels:     labels,
+		CPU:        runtime.NumCPU(),
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	node.Hostname = hostname
+
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && !ipnet.IP.IsLoopback() {
+			node.IPs = append(node.IPs, ipnet.IP.String())
+		}
+	}
+
+	//daemon连不上时也要能注册,docker相关的信息留空
+	if !DockerAvailable() {
+		log.Warn("docker daemon unavailable, register without docker info")
+		return node, nil
+	}
+	env, err := globalClient.Version()
+	if err != nil {
+		return nil, err
+	}
+	node.DockerVersion = env.Map()
+
+	info, err := globalClient.Info()
+	if err != nil {
+		return nil, err
+	}
+	node.DockerInfo = info
+	if info.NCPU > 0 {
+		node.CPU = info.NCPU
+	}
+	node.Memory = info.MemTotal
+
+	//统计docker数据目录所在分区,远程daemon的目录不在本机上
+	node.Disk.Path = info.DockerRootDir
+	if len(node.Disk.Path) == 0 {
+		node.Disk.Path = "/"
+	}
+	var fs syscall.Statfs_t
+	if !DockerIsLocal() {
+		node.Disk.Path = ""
+	} else if err := syscall.Statfs(node.Disk.Path, &fs); err != nil {
+		log.Errorf("statfs %s fail:%v", node.Disk.Path, err)
+	} else {
+		node.Disk.Total = fs.Blocks * uint64(fs.Bsize)
+		node.Disk.Free = fs.Bavail * uint64(fs.Bsize)
+	}
+
+	imgs, err := globalClient.ListImages(docker.ListImagesOptions{All: false})
+	if err != nil {
+		return nil, err
+	}
+	node.Images = []string{}
+	for _, img := range imgs {
+		for _, tag := range img.RepoTags {
+			if tag != "<none>:<none>" {
+				node.Images = append(node.Images, tag)
+			}
+		}
+	}
+	return node, nil
+}
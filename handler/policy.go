@@ -0,0 +1,155 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+
+	"test/errjson"
+)
+
+// 测试服务器配置的镜像准入策略;registry和repository都是path.Match的通配符,
+// 先看deny,再看allow,allow为空表示不限制
+type Policy struct {
+	AllowRegistries   []string `json:"allow_registries"`
+	DenyRegistries    []string `json:"deny_registries"`
+	AllowRepositories []string `json:"allow_repositories"`
+	DenyRepositories  []string `json:"deny_repositories"`
+	MaxImageSize      int64    `json:"max_image_size"` //字节,0表示不限制
+}
+
+var (
+	policyLock sync.RWMutex
+	policy     Policy
+)
+
+func (p Policy) validate() error {
+	for _, list := range [][]string{p.AllowRegistries, p.DenyRegistries, p.AllowRepositories, p.DenyRepositories} {
+		for _, pattern := range list {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("invalid pattern %q: %v", pattern, err)
+			}
+		}
+	}
+	if p.MaxImageSize < 0 {
+		return fmt.Errorf("invalid max_image_size %d", p.MaxImageSize)
+	}
+	return nil
+}
+
+func matchAny(patterns []string, name string) (string, bool) {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return pattern, true
+		}
+	}
+	return "", false
+}
+
+// 拆成仓库地址和仓库内的路径,没有仓库地址的是docker hub;
+// docker hub的官方镜像补上library/,busybox和library/busybox是同一个
+func splitImage(image string) (string, string) {
+	registry, repo := registryOf(image), image
+	if len(registry) == 0 {
+		registry = dockerHubServer
+	} else {
+		repo = image[strings.Index(image, "/")+1:]
+	}
+	if registry == dockerHubServer && !strings.Contains(repo, "/") {
+		repo = "library/" + repo
+	}
+	return registry, repo
+}
+
+func (p Policy) check(image string) error {
+	registry, repo := splitImage(image)
+	if rule, ok := matchAny(p.DenyRegistries, registry); ok {
+		return errjson.NewErrForbidden(fmt.Sprintf("image %s denied by deny_registries rule %q", image, rule))
+	}
+	if rule, ok := matchAny(p.DenyRepositories, repo); ok {
+		return errjson.NewErrForbidden(fmt.Sprintf("image %s denied by deny_repositories rule %q", image, rule))
+	}
+	if _, ok := matchAny(p.AllowRegistries, registry); !ok && len(p.AllowRegistries) != 0 {
+		return errjson.NewErrForbidden(fmt.Sprintf("image %s denied: registry %s matches no allow_registries rule", image, registry))
+	}
+	if _, ok := matchAny(p.AllowRepositories, repo); !ok && len(p.AllowRepositories) != 0 {
+		return errjson.NewErrForbidden(fmt.Sprintf("image %s denied: repository %s matches no allow_repositories rule", image, repo))
+	}
+	return nil
+}
+
+func CurrentPolicy() Policy {
+	policyLock.RLock()
+	defer policyLock.RUnlock()
+	return policy
+}
+
+func SetPolicy(p Policy) error {
+	if err := p.validate(); err != nil {
+		return err
+	}
+	policyLock.Lock()
+	policy = p
+	policyLock.Unlock()
+	log.Infof("image policy: allow registries%v repositories%v, deny registries%v repositories%v, max size %d",
+		p.AllowRegistries, p.AllowRepositories, p.DenyRegistries, p.DenyRepositories, p.MaxImageSize)
+	return nil
+}
+
+// 按给出的名字检查,没有仓库地址的按docker hub算;
+// 从配置的仓库拉取时用checkPullPolicy
+func checkImagePolicy(image string) error {
+	err := CurrentPolicy().check(image)
+	if err != nil {
+		log.Warn(err.Error())
+	}
+	return err
+}
+
+// 镜像大小要拉下来才知道,超出限制时删掉刚拉取的tag
+func checkImageSize(image, tag string, remove bool) error {
+	max := CurrentPolicy().MaxImageSize
+	if max == 0 {
+		return nil
+	}
+	info, err := globalClient.InspectImage(imageRef(image, tag))
+	if err != nil {
+		return err
+	}
+	if info.VirtualSize <= max {
+		return nil
+	}
+	if remove {
+		if err := globalClient.RemoveImage(imageRef(image, tag)); err != nil {
+			log.Errorf("remove oversized image [%s:%s] fail:%v", image, tag, err)
+		}
+	}
+	Msg := fmt.Sprintf("image %s:%s denied by max_image_size rule: %d > %d bytes", image, tag, info.VirtualSize, max)
+	log.Warn(Msg)
+	return errjson.NewErrForbidden(Msg)
+}
+
+func GetPolicy(w http.ResponseWriter, r *http.Request) error {
+	return writeJSON(w, r, CurrentPolicy())
+}
+
+func PutPolicy(w http.ResponseWriter, r *http.Request) error {
+	var p Policy
+
+	byteContent, err := ioutil.ReadAll(r.Body)
+	defer r.Body.Close()
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(byteContent, &p); err != nil {
+		return errjson.NewNotValidEntityError(err.Error())
+	}
+	if err := SetPolicy(p); err != nil {
+		return errjson.NewNotValidEntityError(err.Error())
+	}
+	return nil
+}
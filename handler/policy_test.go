@@ -0,0 +1,114 @@
+package handler
+
+import (
+	"reflect"
+	"testing"
+
+	"test/errjson"
+)
+
+func TestPolicyCheck(t *testing.T) {
+	p := Policy{
+		AllowRegistries:   []string{"reg.example.com", "*.corp.local:5000"},
+		DenyRegistries:    []string{"bad.corp.local:5000"},
+		AllowRepositories: []string{"team/*", "library/*", "busybox"},
+		DenyRepositories:  []string{"team/secret-*"},
+	}
+	cases := []struct {
+		image string
+		ok    bool
+	}{
+		{"reg.example.com/team/app", true},
+		{"REG.EXAMPLE.COM/team/app", true},
+		{"build.corp.local:5000/library/go", true},
+		//deny优先于allow
+		{"bad.corp.local:5000/team/app", false},
+		{"reg.example.com/team/secret-app", false},
+		{"other.example.com/team/app", false},
+		{"reg.example.com/other/app", false},
+		//通配符不跨'/'
+		{"reg.example.com/team/a/b", false},
+		//没有仓库地址的是docker hub,不在allow里
+		{"busybox", false},
+	}
+	for _, c := range cases {
+		err := p.check(c.image)
+		if c.ok && err != nil {
+			t.Errorf("%s: %v", c.image, err)
+		}
+		if _, forbidden := err.(errjson.ErrForbidden); !c.ok && !forbidden {
+			t.Errorf("%s: got %v, want forbidden", c.image, err)
+		}
+	}
+}
+
+func TestPolicyEmptyAllow(t *testing.T) {
+	p := Policy{DenyRepositories: []string{"library/*"}}
+	if err := p.check("index.docker.io/team/app"); err != nil {
+		t.Errorf("empty allow list should allow everything not denied: %v", err)
+	}
+	if err := p.check("docker.io/library/busybox"); err == nil {
+		t.Errorf("denied repository allowed")
+	}
+	if err := p.check("busybox"); err == nil {
+		t.Errorf("denied official image allowed without library/")
+	}
+}
+
+// docker hub的各个别名都按index.docker.io检查
+func TestPolicyDockerHubAliases(t *testing.T) {
+	p := Policy{DenyRegistries: []string{"index.docker.io"}}
+	for _, image := range []string{"busybox", "team/app", "docker.io/team/app", "Docker.IO/team/app",
+		"registry-1.docker.io/team/app", "index.docker.io/team/app"} {
+		if _, ok := p.check(image).(errjson.ErrForbidden); !ok {
+			t.Errorf("%s: not denied", image)
+		}
+	}
+}
+
+// 没带仓库地址的镜像从primary拉取,mirror也要检查
+func TestPullPolicy(t *testing.T) {
+	oldRegistries, oldPolicy := Registries(), CurrentPolicy()
+	defer func() {
+		registries = oldRegistries
+		policy = oldPolicy
+	}()
+	registries = RegistryConfig{
+		Primary: Registry{Address: "primary.local:5000"},
+		Mirrors: []Registry{{Address: "mirror.local:5000"}},
+	}
+
+	policy = Policy{AllowRegistries: []string{"primary.local:5000"}}
+	if err := checkPullPolicy("team/app"); err != nil {
+		t.Errorf("image from the allowed primary: %v", err)
+	}
+	if err := checkPullPolicy("other.local:5000/team/app"); err == nil {
+		t.Errorf("image from another registry allowed")
+	}
+
+	policy = Policy{DenyRegistries: []string{"primary.local:5000", "mirror.local:5000"}}
+	if err := checkPullPolicy("team/app"); err == nil {
+		t.Errorf("image denied on every source allowed")
+	}
+	policy = Policy{DenyRegistries: []string{"primary.local:5000"}}
+	if err := checkPullPolicy("team/app"); err != nil {
+		t.Errorf("image allowed on the mirror: %v", err)
+	}
+
+	var got []string
+	for _, src := range registries.sources("team/app") {
+		got = append(got, src.image())
+	}
+	if want := []string{"mirror.local:5000/team/app", "primary.local:5000/team/app"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("sources %v, want %v", got, want)
+	}
+}
+
+func TestPolicyValidate(t *testing.T) {
+	if err := (Policy{AllowRepositories: []string{"team/["}}).validate(); err == nil {
+		t.Errorf("invalid pattern accepted")
+	}
+	if err := (Policy{MaxImageSize: -1}).validate(); err == nil {
+		t.Errorf("negative max_image_size accepted")
+	}
+}
@@ -0,0 +1,247 @@
+package handler
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"test/errjson"
+
+	"test/Godeps/_workspace/src/github.com/gorilla/mux"
+)
+
+const defaultMaxRuns = 4
+
+type queueEntry struct {
+	run      *Run
+	project  string
+	priority int
+	seq      uint64
+	queuedAt time.Time
+}
+
+// 本地run队列:优先级高的先执行,同优先级下正在执行run少的project优先,最后按入队顺序
+type runQueue struct {
+	sync.Mutex
+	pending []*queueEntry
+	seq     uint64
+	maxRuns int
+}
+
+var queue = &runQueue{maxRuns: defaultMaxRuns}
+
+func SetMaxRuns(n int) {
+	if n <= 0 {
+		n = defaultMaxRuns
+	}
+	queue.Lock()
+	queue.maxRuns = n
+	queue.Unlock()
+	queue.dispatch()
+}
+
+// 在队列锁内检查状态,避免和drain/shutdown交错时把run放进已经清空的队列
+func (q *runQueue) push(run *Run) error {
+	q.Lock()
+	if err := acceptingWork(); err != nil {
+		q.Unlock()
+		return err
+	}
+	runs.add(run)
+	q.seq++
+	q.pending = append(q.pending, &queueEntry{
+		run:      run,
+		project:  run.Spec.Project,
+		priority: run.Spec.Priority,
+		seq:      q.seq,
+		queuedAt: run.Created,
+	})
+	q.Unlock()
+	q.dispatch()
+	return nil
+}
+
+func (q *runQueue) find(id string) int {
+	for i, entry := range q.pending {
+		if entry.run.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// 在容量允许的范围内,把排在最前面的run取出来执行;draining时排队的run保持不动
+func (q *runQueue) dispatch() {
+	q.Lock()
+	defer q.Unlock()
+
+	if WorkState() != StateAccepting {
+		return
+	}
+
+	active := runs.activeByProject()
+	total := 0
+	for _, n := range active {
+		total += n
+	}
+
+	for total < q.maxRuns && len(q.pending) > 0 {
+		i := pick(q.pending, active)
+		entry := q.pending[i]
+		q.pending = append(q.pending[:i], q.pending[i+1:]...)
+
+		runs.setState(entry.run, RunPending)
+		active[entry.project]++
+		total++
+		go startRun(entry.run)
+	}
+}
+
+func pick(pending []*queueEntry, active map[string]int) int {
+	best := 0
+	for i := 1; i < len(pending); i++ {
+		if before(pending[i], pending[best], active) {
+			best = i
+		}
+	}
+	return best
+}
+
+func before(a, b *queueEntry, active map[string]int) bool {
+	if a.priority != b.priority {
+		return a.priority > b.priority
+	}
+	if active[a.project] != active[b.project] {
+		return active[a.project] < active[b.project]
+	}
+	return a.seq < b.seq
+}
+
+type QueueItem struct {
+	Position int       `json:"position"`
+	RunID    string    `json:"run_id"`
+	Project  string    `json:"project"`
+	Priority int       `json:"priority"`
+	QueuedAt time.Time `json:"queued_at"`
+}
+
+type QueueStatus struct {
+	MaxRuns int         `json:"max_runs"`
+	Active  int         `json:"active"`
+	Pending []QueueItem `json:"pending"`
+}
+
+// 按dispatch的规则模拟出队,得到预计的执行顺序
+func (q *runQueue) status() QueueStatus {
+	q.Lock()
+	defer q.Unlock()
+
+	active := runs.activeByProject()
+	status := QueueStatus{MaxRuns: q.maxRuns, Pending: []QueueItem{}}
+	for _, n := range active {
+		status.Active += n
+	}
+
+	rest := make([]*queueEntry, len(q.pending))
+	copy(rest, q.pending)
+	for len(rest) > 0 {
+		i := pick(rest, active)
+		entry := rest[i]
+		rest = append(rest[:i], rest[i+1:]...)
+		active[entry.project]++
+
+		status.Pending = append(status.Pending, QueueItem{
+			Position: len(status.Pending) + 1,
+			RunID:    entry.run.ID,
+			Project:  entry.project,
+			Priority: entry.priority,
+			QueuedAt: entry.queuedAt,
+		})
+	}
+	return status
+}
+
+func (q *runQueue) reprioritize(id string, priority int) bool {
+	q.Lock()
+	defer q.Unlock()
+
+	i := q.find(id)
+	if i < 0 {
+		return false
+	}
+	entry := q.pending[i]
+	entry.priority = priority
+
+	runs.Lock()
+	entry.run.Spec.Priority = priority
+	runs.Unlock()
+	return true
+}
+
+func (q *runQueue) remove(id string) bool {
+	q.Lock()
+	defer q.Unlock()
+
+	i := q.find(id)
+	if i < 0 {
+		return false
+	}
+	entry := q.pending[i]
+	q.pending = append(q.pending[:i], q.pending[i+1:]...)
+	runs.setState(entry.run, RunCancelled)
+	return true
+}
+
+// 清空队列,返回被取消的run
+func (q *runQueue) drain() []*Run {
+	q.Lock()
+	defer q.Unlock()
+
+	var cancelled []*Run
+	for _, entry := range q.pending {
+		runs.setState(entry.run, RunCancelled)
+		cancelled = append(cancelled, entry.run)
+	}
+	q.pending = nil
+	return cancelled
+}
+
+func GetQueue(w http.ResponseWriter, r *http.Request) error {
+	return writeJSON(w, r, queue.status())
+}
+
+type PriorityOpt struct {
+	Priority int `json:"priority" validate:"required"`
+}
+
+func ReprioritizeRun(w http.ResponseWriter, r *http.Request) error {
+	var opt PriorityOpt
+	id := mux.Vars(r)["id"]
+
+	byteContent, err := ioutil.ReadAll(r.Body)
+	defer r.Body.Close()
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(byteContent, &opt); err != nil {
+		return errjson.NewNotValidEntityError(err.Error())
+	}
+
+	if !queue.reprioritize(id, opt.Priority) {
+		return errjson.NewNotFoundError("run " + id + " is not queued")
+	}
+	log.Infof("run[%s]: priority set to %d", id, opt.Priority)
+	return nil
+}
+
+func DequeueRun(w http.ResponseWriter, r *http.Request) error {
+	id := mux.Vars(r)["id"]
+
+	if !queue.remove(id) {
+		return errjson.NewNotFoundError("run " + id + " is not queued")
+	}
+	log.Infof("run[%s]: removed from queue", id)
+	return nil
+}
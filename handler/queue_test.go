@@ -0,0 +1,94 @@
+package handler
+
+import (
+	"reflect"
+	"testing"
+)
+
+func resetQueue() {
+	queue.Lock()
+	queue.pending = nil
+	queue.Unlock()
+	runs.Lock()
+	runs.runs = make(map[string]*Run)
+	runs.byContainer = make(map[string]*Run)
+	runs.Unlock()
+}
+
+func TestQueueOrder(t *testing.T) {
+	cases := []struct {
+		name    string
+		pending []*queueEntry
+		active  map[string]int
+		want    []string
+	}{
+		{"fifo", []*queueEntry{
+			{run: &Run{ID: "a"}, project: "p", seq: 1},
+			{run: &Run{ID: "b"}, project: "p", seq: 2},
+			{run: &Run{ID: "c"}, project: "p", seq: 3},
+		}, nil, []string{"a", "b", "c"}},
+		{"priority first", []*queueEntry{
+			{run: &Run{ID: "a"}, project: "p", seq: 1},
+			{run: &Run{ID: "b"}, project: "p", priority: 5, seq: 2},
+			{run: &Run{ID: "c"}, project: "q", priority: 1, seq: 3},
+		}, nil, []string{"b", "c", "a"}},
+		//同优先级下轮流给各个project
+		{"fair share", []*queueEntry{
+			{run: &Run{ID: "a1"}, project: "a", seq: 1},
+			{run: &Run{ID: "a2"}, project: "a", seq: 2},
+			{run: &Run{ID: "a3"}, project: "a", seq: 3},
+			{run: &Run{ID: "b1"}, project: "b", seq: 4},
+			{run: &Run{ID: "b2"}, project: "b", seq: 5},
+		}, nil, []string{"a1", "b1", "a2", "b2", "a3"}},
+		{"busy project waits", []*queueEntry{
+			{run: &Run{ID: "a1"}, project: "a", seq: 1},
+			{run: &Run{ID: "b1"}, project: "b", seq: 2},
+		}, map[string]int{"a": 2}, []string{"b1", "a1"}},
+		{"priority beats fair share", []*queueEntry{
+			{run: &Run{ID: "b1"}, project: "b", seq: 1},
+			{run: &Run{ID: "a1"}, project: "a", priority: 1, seq: 2},
+		}, map[string]int{"a": 3}, []string{"a1", "b1"}},
+	}
+	for _, c := range cases {
+		active := make(map[string]int)
+		for k, v := range c.active {
+			active[k] = v
+		}
+		rest := c.pending
+		var got []string
+		for len(rest) > 0 {
+			i := pick(rest, active)
+			active[rest[i].project]++
+			got = append(got, rest[i].run.ID)
+			rest = append(rest[:i:i], rest[i+1:]...)
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: got %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+// status按dispatch的规则给出预计顺序,正在执行的run也计入fair share
+func TestQueueStatus(t *testing.T) {
+	defer resetQueue()
+	runs.add(&Run{ID: "running", State: RunRunning, Spec: RunSpec{Project: "a"}})
+	q := &runQueue{maxRuns: 2, pending: []*queueEntry{
+		{run: &Run{ID: "a1"}, project: "a", seq: 1},
+		{run: &Run{ID: "b1"}, project: "b", seq: 2},
+		{run: &Run{ID: "b2"}, project: "b", seq: 3},
+	}}
+	status := q.status()
+	if status.Active != 1 || status.MaxRuns != 2 {
+		t.Errorf("active %d max %d", status.Active, status.MaxRuns)
+	}
+	var got []string
+	for i, item := range status.Pending {
+		if item.Position != i+1 {
+			t.Errorf("%s: position %d, want %d", item.RunID, item.Position, i+1)
+		}
+		got = append(got, item.RunID)
+	}
+	if want := []string{"b1", "a1", "b2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("order %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,272 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"test/errjson"
+
+	docker "test/Godeps/_workspace/src/github.com/fsouza/go-dockerclient"
+)
+
+const defaultPullTimeout = 30 * time.Minute
+
+const redactedPassword = "******"
+
+// 拉取由docker daemon完成,http仓库需要在daemon上配置--insecure-registry,
+// agent无法按仓库设置,所以不接受insecure
+type Registry struct {
+	Address  string `json:"address" validate:"required"` //IP:Port
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	//秒,0表示使用默认值;超时后放弃这个仓库,换下一个
+	Timeout  int  `json:"timeout"`
+	Insecure bool `json:"insecure,omitempty"`
+}
+
+// 拉取时先依次尝试mirror,都失败后再从primary拉取;
+// extra是其他可以直接访问的仓库
+type RegistryConfig struct {
+	Primary Registry   `json:"primary" validate:"required"`
+	Mirrors []Registry `json:"mirrors"`
+	Extra   []Registry `json:"extra"`
+}
+
+var (
+	registryLock sync.RWMutex
+	registries   RegistryConfig
+)
+
+func (r Registry) timeout() time.Duration {
+	if r.Timeout <= 0 {
+		return defaultPullTimeout
+	}
+	return time.Duration(r.Timeout) * time.Second
+}
+
+func (r Registry) redacted() Registry {
+	if len(r.Password) != 0 {
+		r.Password = redactedPassword
+	}
+	return r
+}
+
+func (c RegistryConfig) validate() error {
+	if len(c.Primary.Address) == 0 {
+		return errors.New("primary registry is empty")
+	}
+	for _, r := range c.all() {
+		if len(r.Address) == 0 {
+			return errors.New("registry address is empty")
+		}
+		if r.Timeout < 0 {
+			return fmt.Errorf("registry %s: negative timeout", r.Address)
+		}
+		if r.Insecure {
+			return fmt.Errorf("registry %s: insecure is not supported, add it to --insecure-registry of the docker daemon", r.Address)
+		}
+	}
+	return nil
+}
+
+func (c RegistryConfig) all() []Registry {
+	all := append([]Registry{c.Primary}, c.Extra...)
+	return append(all, c.Mirrors...)
+}
+
+func (c RegistryConfig) redacted() RegistryConfig {
+	out := RegistryConfig{Primary: c.Primary.redacted()}
+	for _, r := range c.Mirrors {
+		out.Mirrors = append(out.Mirrors, r.redacted())
+	}
+	for _, r := range c.Extra {
+		out.Extra = append(out.Extra, r.redacted())
+	}
+	return out
+}
+
+// 镜像名以哪个仓库开头,就使用哪个仓库的配置
+func (c RegistryConfig) lookup(image string) (Registry, bool) {
+	for _, r := range c.all() {
+		if strings.HasPrefix(image, r.Address+"/") {
+			return r, true
+		}
+	}
+	return Registry{}, false
+}
+
+type pullSource struct {
+	registry   Registry
+	repository string
+}
+
+// 没带仓库地址的名字由daemon从registry参数给的仓库拉取
+func (s pullSource) image() string {
+	if len(registryOf(s.repository)) != 0 || len(s.registry.Address) == 0 {
+		return s.repository
+	}
+	return s.registry.Address + "/" + s.repository
+}
+
+func (c RegistryConfig) sources(image string) []pullSource {
+	if r, ok := c.lookup(image); ok && r.Address != c.Primary.Address {
+		return []pullSource{{registry: r, repository: image}}
+	}
+
+	name := strings.TrimPrefix(image, c.Primary.Address+"/")
+	var sources []pullSource
+	for _, m := range c.Mirrors {
+		sources = append(sources, pullSource{registry: m, repository: m.Address + "/" + name})
+	}
+	return append(sources, pullSource{registry: c.Primary, repository: image})
+}
+
+func Registries() RegistryConfig {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+	return registries
+}
+
+func SetRegistries(cfg RegistryConfig) error {
+	if err := cfg.validate(); err != nil {
+		return err
+	}
+	registryLock.Lock()
+	registries = cfg
+	registryLock.Unlock()
+	log.Infof("registries: primary[%s] mirrors[%d] extra[%d]", cfg.Primary.Address, len(cfg.Mirrors), len(cfg.Extra))
+	return nil
+}
+
+// 按拉取时实际访问的仓库检查策略,有一个来源允许就可以拉取
+func checkPullPolicy(image string) error {
+	var err error
+	for _, src := range Registries().sources(image) {
+		if err = checkImagePolicy(src.image()); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func authFor(r Registry) docker.AuthConfiguration {
+	if len(r.Username) != 0 {
+		return docker.AuthConfiguration{
+			Username:      r.Username,
+			Password:      r.Password,
+			ServerAddress: r.Address,
+		}
+	}
+	return credentialsFor(r.Address)
+}
+
+// 推送等操作使用镜像所在仓库的认证信息
+func authForImage(image string) docker.AuthConfiguration {
+	cfg := Registries()
+	if r, ok := cfg.lookup(image); ok {
+		return authFor(r)
+	}
+	return credentialsFor(registryOf(image))
+}
+
+// 超时后断开和daemon的连接,daemon会取消这次拉取,之后才换下一个仓库
+func pullFrom(src pullSource, tag string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), src.registry.timeout())
+	defer cancel()
+	err := pullImageContext(ctx, src.repository, tag, src.registry.Address, authFor(src.registry))
+	if err == context.DeadlineExceeded {
+		return fmt.Errorf("pull %s:%s from %s timeout after %v", src.repository, tag, src.registry.Address, src.registry.timeout())
+	}
+	return err
+}
+
+// 按mirror -> primary的顺序拉取,从mirror拉到后打上原来的名字;
+// 都失败时返回最后一个(primary的)错误,由writeError按类型转换状态码
+func pullImage(image, tag, digest string) error {
+	var lastErr error
+	for _, src := range Registries().sources(image) {
+		//策略不允许的来源直接跳过
+		if err := checkImagePolicy(src.image()); err != nil {
+			lastErr = err
+			continue
+		}
+		err := pullFrom(src, tag)
+		if err != nil {
+			log.Warnf("pull [%s:%s] from %s fail:%v", src.repository, tag, src.registry.Address, err)
+			lastErr = err
+			continue
+		}
+		if src.repository != image {
+			opts := docker.TagImageOptions{Repo: image, Tag: tag, Force: true}
+			if err := globalClient.TagImage(imageRef(src.repository, tag), opts); err != nil {
+				return err
+			}
+		}
+		if err := checkImageSize(image, tag, true); err != nil {
+			return err
+		}
+		return verifyDigest(image, tag, digest)
+	}
+	return lastErr
+}
+
+func GetRegistries(w http.ResponseWriter, r *http.Request) error {
+	return writeJSON(w, r, Registries().redacted())
+}
+
+func PutRegistries(w http.ResponseWriter, r *http.Request) error {
+	var cfg RegistryConfig
+
+	byteContent, err := ioutil.ReadAll(r.Body)
+	defer r.Body.Close()
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(byteContent, &cfg); err != nil {
+		return errjson.NewNotValidEntityError(err.Error())
+	}
+	if err := keepPasswords(&cfg, Registries()); err != nil {
+		return errjson.NewNotValidEntityError(err.Error())
+	}
+	if err := SetRegistries(cfg); err != nil {
+		return errjson.NewNotValidEntityError(err.Error())
+	}
+	return nil
+}
+
+// GET返回的密码是打码的,原样PUT回来时沿用同一地址已经保存的密码
+func keepPasswords(cfg *RegistryConfig, old RegistryConfig) error {
+	keep := func(r *Registry) error {
+		if r.Password != redactedPassword {
+			return nil
+		}
+		for _, o := range old.all() {
+			if o.Address == r.Address && len(o.Password) != 0 {
+				r.Password = o.Password
+				return nil
+			}
+		}
+		return fmt.Errorf("registry %s: no saved password to keep", r.Address)
+	}
+	if err := keep(&cfg.Primary); err != nil {
+		return err
+	}
+	for i := range cfg.Mirrors {
+		if err := keep(&cfg.Mirrors[i]); err != nil {
+			return err
+		}
+	}
+	for i := range cfg.Extra {
+		if err := keep(&cfg.Extra[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
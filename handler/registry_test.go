@@ -0,0 +1,112 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 用httptest假装docker daemon,mirror一直不返回
+func fakeDaemon(t *testing.T) (cancelled chan string, done func()) {
+	cancelled = make(chan string, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		image := r.URL.Query().Get("fromImage")
+		if !strings.HasPrefix(image, r.URL.Query().Get("registry")+"/") {
+			t.Errorf("pull %s from registry %q", image, r.URL.Query().Get("registry"))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case strings.HasPrefix(image, "mirror"):
+			w.Write([]byte(`{"status":"Pulling fs layer"}`))
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+			cancelled <- image
+		case strings.HasPrefix(image, "broken"):
+			w.Write([]byte(`{"status":"Pulling"}{"error":"manifest unknown"}`))
+		default:
+			w.Write([]byte(`{"status":"Downloaded newer image"}`))
+		}
+	}))
+	oldEndpoint, oldClient := dockerEndpoint, globalClient
+	dockerEndpoint = DockerEndpoint{Endpoint: strings.Replace(srv.URL, "http://", "tcp://", 1)}
+	client, err := newDockerClient(dockerEndpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	globalClient = &DockerClient{client, 0}
+	return cancelled, func() {
+		srv.Close()
+		dockerEndpoint, globalClient = oldEndpoint, oldClient
+	}
+}
+
+func TestPullFromTimeout(t *testing.T) {
+	cancelled, done := fakeDaemon(t)
+	defer done()
+
+	start := time.Now()
+	err := pullFrom(pullSource{registry: Registry{Address: "mirror", Timeout: 1}, repository: "mirror/team/app"}, "latest")
+	if err == nil || !strings.Contains(err.Error(), "timeout") {
+		t.Errorf("hung mirror: %v", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("pull returned after %v", d)
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Errorf("daemon request not cancelled")
+	}
+
+	if err := pullFrom(pullSource{registry: Registry{Address: "primary"}, repository: "primary/team/app"}, "latest"); err != nil {
+		t.Errorf("primary: %v", err)
+	}
+	if err := pullFrom(pullSource{registry: Registry{Address: "broken"}, repository: "broken/team/app"}, "latest"); err == nil || err.Error() != "manifest unknown" {
+		t.Errorf("error in stream: %v", err)
+	}
+}
+
+func TestRegistryValidate(t *testing.T) {
+	ok := RegistryConfig{Primary: Registry{Address: "p"}, Mirrors: []Registry{{Address: "m", Timeout: 10}}}
+	if err := ok.validate(); err != nil {
+		t.Errorf("valid config: %v", err)
+	}
+	bad := []RegistryConfig{
+		{},
+		{Primary: Registry{Address: "p"}, Mirrors: []Registry{{}}},
+		{Primary: Registry{Address: "p"}, Mirrors: []Registry{{Address: "m", Timeout: -1}}},
+		{Primary: Registry{Address: "p"}, Extra: []Registry{{Address: "e", Insecure: true}}},
+	}
+	for _, c := range bad {
+		if err := c.validate(); err == nil {
+			t.Errorf("%+v accepted", c)
+		}
+	}
+}
+
+// GET到的配置原样PUT回来,密码不能变成******
+func TestKeepPasswords(t *testing.T) {
+	old := RegistryConfig{
+		Primary: Registry{Address: "p", Username: "u", Password: "secret"},
+		Mirrors: []Registry{{Address: "m", Username: "u", Password: "mirror-secret"}},
+	}
+	cfg := old.redacted()
+	if err := keepPasswords(&cfg, old); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Primary.Password != "secret" || cfg.Mirrors[0].Password != "mirror-secret" {
+		t.Errorf("passwords %q %q", cfg.Primary.Password, cfg.Mirrors[0].Password)
+	}
+
+	changed := RegistryConfig{Primary: Registry{Address: "p", Username: "u", Password: "new"}}
+	if err := keepPasswords(&changed, old); err != nil || changed.Primary.Password != "new" {
+		t.Errorf("new password: %q, %v", changed.Primary.Password, err)
+	}
+
+	unknown := RegistryConfig{Primary: Registry{Address: "other", Username: "u", Password: redactedPassword}}
+	if err := keepPasswords(&unknown, old); err == nil {
+		t.Errorf("redacted password for an unknown registry accepted")
+	}
+}
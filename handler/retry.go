@@ -0,0 +1,317 @@
+package handler
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"test/errjson"
+
+	docker "test/Godeps/_workspace/src/github.com/fsouza/go-dockerclient"
+	"test/Godeps/_workspace/src/github.com/gorilla/mux"
+)
+
+const (
+	attemptLogFile = "output.log"
+	maxBackoff     = 10 * time.Minute
+)
+
+var runDataDir = "./runs"
+
+type RetryPolicy struct {
+	MaxAttempts int `json:"max_attempts"`
+	//为空时所有非0退出码都可以重试
+	ExitCodes      []int `json:"exit_codes"`
+	BackoffSeconds int   `json:"backoff_seconds"`
+	//每次重试等待时间翻倍,直到这个上限
+	MaxBackoffSeconds int `json:"max_backoff_seconds"`
+}
+
+func (p *RetryPolicy) retryable(job *Job, attempts int) bool {
+	if p == nil || attempts >= p.MaxAttempts {
+		return false
+	}
+	switch job.State {
+	case RunFailed, RunKilled, RunOOM:
+	default:
+		return false
+	}
+	if len(p.ExitCodes) == 0 {
+		return true
+	}
+	for _, code := range p.ExitCodes {
+		if code == job.ExitCode {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *RetryPolicy) backoff(attempts int) time.Duration {
+	limit := maxBackoff
+	if p.MaxBackoffSeconds > 0 {
+		limit = time.Duration(p.MaxBackoffSeconds) * time.Second
+	}
+	d := time.Duration(p.BackoffSeconds) * time.Second
+	for i := 1; i < attempts && d < limit; i++ {
+		d *= 2
+	}
+	if d > limit {
+		d = limit
+	}
+	return d
+}
+
+func attemptDir(runID string, attempt int) string {
+	return filepath.Join(runDataDir, runID, strconv.Itoa(attempt))
+}
+
+// 保存一次尝试的容器日志和产物,失败只记录日志,不影响run的结果
+func collectAttempt(run *Run, job *Job) (string, []string) {
+	dir := attemptDir(run.ID, job.Attempt)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.Errorf("run[%s]: create dir %s fail:%v", run.ID, dir, err)
+		return "", nil
+	}
+
+	logFile := ""
+	fp, err := os.Create(filepath.Join(dir, attemptLogFile))
+	if err != nil {
+		log.Errorf("run[%s]: create log file fail:%v", run.ID, err)
+	} else {
+		err = globalClient.Logs(docker.LogsOptions{
+			Container:    job.ContainerID,
+			OutputStream: fp,
+			ErrorStream:  fp,
+			Stdout:       true,
+			Stderr:       true,
+		})
+		fp.Close()
+		if err != nil {
+			log.Errorf("run[%s]: attempt %d get logs fail:%v", run.ID, job.Attempt, err)
+		} else {
+			logFile = attemptLogFile
+		}
+	}
+
+	var artifacts []string
+	for i, path := range run.Spec.Artifacts {
+		name := fmt.Sprintf("%d-%s.tar", i, filepath.Base(path))
+		fp, err := os.Create(filepath.Join(dir, name))
+		if err != nil {
+			log.Errorf("run[%s]: create artifact file fail:%v", run.ID, err)
+			continue
+		}
+		err = globalClient.DownloadFromContainer(job.ContainerID, docker.DownloadFromContainerOptions{
+			Path:         path,
+			OutputStream: fp,
+		})
+		fp.Close()
+		if err != nil {
+			log.Errorf("run[%s]: attempt %d download %s fail:%v", run.ID, job.Attempt, path, err)
+			os.Remove(filepath.Join(dir, name))
+			continue
+		}
+		artifacts = append(artifacts, name)
+	}
+	return logFile, artifacts
+}
+
+// 日志已经保存下来的容器直接删掉,没保存成功的留着排查
+func removeAttempt(run *Run, job *Job, logFile string) {
+	if len(logFile) == 0 {
+		log.Warnf("run[%s]: attempt %d log not collected, keep container [%s]", run.ID, job.Attempt, job.ContainerID)
+		return
+	}
+	err := globalClient.RemoveContainer(docker.RemoveContainerOptions{ID: job.ContainerID, RemoveVolumes: true})
+	if err != nil {
+		log.Errorf("run[%s]: attempt %d remove container [%s] fail:%v", run.ID, job.Attempt, job.ContainerID, err)
+	}
+}
+
+func finishAttempt(run *Run, job *Job) {
+	logFile, artifacts := collectAttempt(run, job)
+
+	runs.Lock()
+	job.LogFile = logFile
+	job.Artifacts = artifacts
+
+	attempts := len(run.Attempts)
+	policy := run.Spec.Retry
+	retry := false
+	switch {
+	case job.State == RunSucceeded && attempts > 1:
+		run.State = RunFlakyPassed
+	//draining和shutting-down时不再重试,这时结束的多半是被停掉的容器
+	case WorkState() == StateAccepting && policy.retryable(job, attempts):
+		run.State = RunRetrying
+		retry = true
+	default:
+		run.State = job.State
+	}
+	state := run.State
+	runs.Unlock()
+	//先记下日志文件再删容器,查询日志时不会两边都找不到
+	removeAttempt(run, job, logFile)
+
+	if !retry {
+		log.Infof("run[%s]: finished as %s after %d attempt(s)", run.ID, state, attempts)
+		publishEvent(Event{Type: "run", Action: "finish", RunID: run.ID, Attempt: attempts, State: state, Time: time.Now().Unix()})
+		queue.dispatch()
+		return
+	}
+
+	wait := policy.backoff(attempts)
+	log.Infof("run[%s]: attempt %d %s, retry in %v", run.ID, attempts, job.State, wait)
+	publishEvent(Event{Type: "run", Action: "retry", RunID: run.ID, Attempt: attempts, State: state, Time: time.Now().Unix()})
+	runs.Lock()
+	run.retryTimer = time.AfterFunc(wait, func() {
+		startAttempt(run)
+	})
+	runs.Unlock()
+}
+
+// 取消还在等待重试的run,返回被取消的run
+func cancelRetries() []*Run {
+	runs.Lock()
+	var cancelled []*Run
+	var events []Event
+	for _, run := range runs.runs {
+		if run.State != RunRetrying || run.retryTimer == nil {
+			continue
+		}
+		//定时器已经触发的,交给startAttempt处理
+		if !run.retryTimer.Stop() {
+			continue
+		}
+		run.State = RunCancelled
+		cancelled = append(cancelled, run)
+		events = append(events, Event{Type: "run", Action: "finish", RunID: run.ID, Attempt: len(run.Attempts), State: RunCancelled, Time: time.Now().Unix()})
+	}
+	runs.Unlock()
+
+	for _, e := range events {
+		publishEvent(e)
+	}
+	return cancelled
+}
+
+func attemptFromRequest(r *http.Request) (*Job, string, error) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+	n, err := strconv.Atoi(vars["attempt"])
+	if err != nil {
+		return nil, "", errjson.NewNotValidEntityError("invalid attempt " + vars["attempt"])
+	}
+
+	runs.RLock()
+	defer runs.RUnlock()
+	run, ok := runs.runs[id]
+	if !ok {
+		return nil, "", errjson.NewNotFoundError("run " + id + " not found")
+	}
+	job := run.attempt(n)
+	if job == nil {
+		return nil, "", errjson.NewNotFoundError(fmt.Sprintf("run %s has no attempt %d", id, n))
+	}
+	j := *job
+	return &j, attemptDir(id, n), nil
+}
+
+func GetAttemptLog(w http.ResponseWriter, r *http.Request) error {
+	job, dir, err := attemptFromRequest(r)
+	if err != nil {
+		return err
+	}
+	if len(job.LogFile) != 0 {
+		w.Header().Set("Content-Type", "text/plain")
+		http.ServeFile(w, r, filepath.Join(dir, job.LogFile))
+		return nil
+	}
+	//还没收集时直接读容器日志,follow=true时一直输出到容器退出
+	if len(job.ContainerID) == 0 || job.Removed {
+		return errjson.NewNotFoundError("log not collected yet")
+	}
+	follow, _ := strconv.ParseBool(r.URL.Query().Get("follow"))
+	//反向连接的响应要整体缓存后回传,follow要等到容器退出才有输出
+	if follow && viaTunnel(r) {
+		return errjson.NewNotValidEntityError("follow is not supported over the tunnel")
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	fw := &flushWriter{w: w}
+	errC := make(chan error, 1)
+	go func() {
+		errC <- globalClient.Logs(docker.LogsOptions{
+			Container:    job.ContainerID,
+			OutputStream: fw,
+			ErrorStream:  fw,
+			Stdout:       true,
+			Stderr:       true,
+			Follow:       follow,
+		})
+	}()
+	select {
+	case err = <-errC:
+	case <-r.Context().Done():
+		//调用方断开了;Logs没法中断,之后的写入都返回错误,容器再有输出或退出时Logs就会结束
+		fw.close()
+		return nil
+	}
+	if err != nil && fw.wrote {
+		//已经开始输出,不能再返回错误
+		log.Errorf("stream log of container %s fail:%v", job.ContainerID, err)
+		return nil
+	}
+	return err
+}
+
+// 每次写完立即flush,让调用方实时看到容器输出
+type flushWriter struct {
+	sync.Mutex
+	w      http.ResponseWriter
+	wrote  bool
+	closed bool
+}
+
+func (fw *flushWriter) Write(b []byte) (int, error) {
+	fw.Lock()
+	defer fw.Unlock()
+	if fw.closed {
+		return 0, io.ErrClosedPipe
+	}
+	fw.wrote = true
+	n, err := fw.w.Write(b)
+	if f, ok := fw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return n, err
+}
+
+// handler返回后不能再写w
+func (fw *flushWriter) close() {
+	fw.Lock()
+	fw.closed = true
+	fw.Unlock()
+}
+
+func GetAttemptArtifact(w http.ResponseWriter, r *http.Request) error {
+	job, dir, err := attemptFromRequest(r)
+	if err != nil {
+		return err
+	}
+	name := mux.Vars(r)["name"]
+	//只允许下载登记过的产物,避免路径穿越
+	for _, artifact := range job.Artifacts {
+		if artifact == name {
+			w.Header().Set("Content-Type", "application/x-tar")
+			http.ServeFile(w, r, filepath.Join(dir, name))
+			return nil
+		}
+	}
+	return errjson.NewNotFoundError("artifact " + name + " not found")
+}
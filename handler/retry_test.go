@@ -0,0 +1,54 @@
+package handler
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetryable(t *testing.T) {
+	policy := &RetryPolicy{MaxAttempts: 3}
+	codes := &RetryPolicy{MaxAttempts: 3, ExitCodes: []int{2}}
+	cases := []struct {
+		name     string
+		policy   *RetryPolicy
+		job      Job
+		attempts int
+		want     bool
+	}{
+		{"no policy", nil, Job{State: RunFailed, ExitCode: 1}, 1, false},
+		{"failed", policy, Job{State: RunFailed, ExitCode: 1}, 1, true},
+		{"killed", policy, Job{State: RunKilled, ExitCode: 137}, 2, true},
+		{"oom", policy, Job{State: RunOOM}, 1, true},
+		{"succeeded", policy, Job{State: RunSucceeded}, 1, false},
+		{"lost", policy, Job{State: RunLost}, 1, false},
+		{"max attempts", policy, Job{State: RunFailed, ExitCode: 1}, 3, false},
+		{"exit code listed", codes, Job{State: RunFailed, ExitCode: 2}, 1, true},
+		{"exit code not listed", codes, Job{State: RunFailed, ExitCode: 1}, 1, false},
+	}
+	for _, c := range cases {
+		if got := c.policy.retryable(&c.job, c.attempts); got != c.want {
+			t.Errorf("%s: retryable %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	cases := []struct {
+		policy   RetryPolicy
+		attempts int
+		want     time.Duration
+	}{
+		{RetryPolicy{}, 1, 0},
+		{RetryPolicy{BackoffSeconds: 5}, 1, 5 * time.Second},
+		{RetryPolicy{BackoffSeconds: 5}, 2, 10 * time.Second},
+		{RetryPolicy{BackoffSeconds: 5}, 4, 40 * time.Second},
+		{RetryPolicy{BackoffSeconds: 5, MaxBackoffSeconds: 30}, 4, 30 * time.Second},
+		{RetryPolicy{BackoffSeconds: 60}, 20, maxBackoff},
+		{RetryPolicy{BackoffSeconds: 3600}, 1, maxBackoff},
+	}
+	for _, c := range cases {
+		if got := c.policy.backoff(c.attempts); got != c.want {
+			t.Errorf("%+v attempt %d: backoff %v, want %v", c.policy, c.attempts, got, c.want)
+		}
+	}
+}
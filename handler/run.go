@@ -0,0 +1,313 @@
+package handler
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"test/errjson"
+
+	docker "test/Godeps/_workspace/src/github.com/fsouza/go-dockerclient"
+	"test/Godeps/_workspace/src/github.com/gorilla/mux"
+)
+
+const (
+	RunQueued      = "queued"
+	RunPending     = "pending"
+	RunRunning     = "running"
+	RunSucceeded   = "succeeded"
+	RunFailed      = "failed"
+	RunKilled      = "killed"
+	RunOOM         = "oom"
+	RunLost        = "lost"
+	RunCancelled   = "cancelled"
+	RunRetrying    = "retrying"     //失败后等待重试
+	RunFlakyPassed = "flaky-passed" //重试后成功
+
+	runLabel = "autotest.run"
+)
+
+type RunSpec struct {
+	Image    string   `json:"image" validate:"required"`
+	Tag      string   `json:"tag" validate:"required"`
+	Digest   string   `json:"digest,omitempty"` //期望的镜像digest,sha256:...
+	Cmd      []string `json:"cmd"`
+	Env      []string `json:"env"`
+	Project  string   `json:"project"`
+	Priority int      `json:"priority"`
+	//结束后从容器中取回的路径
+	Artifacts []string     `json:"artifacts"`
+	Retry     *RetryPolicy `json:"retry,omitempty"`
+}
+
+// 一个job对应run的一次尝试(一个容器)
+type Job struct {
+	Attempt     int       `json:"attempt"`
+	ContainerID string    `json:"container_id"`
+	State       string    `json:"state"`
+	ExitCode    int       `json:"exit_code"`
+	OOMKilled   bool      `json:"oom_killed"`
+	Killed      bool      `json:"killed"`
+	Removed     bool      `json:"removed"`
+	Error       string    `json:"error,omitempty"`
+	StartedAt   time.Time `json:"started_at"`
+	FinishedAt  time.Time `json:"finished_at"`
+	LogFile     string    `json:"log_file,omitempty"`
+	Artifacts   []string  `json:"artifacts,omitempty"`
+}
+
+type Run struct {
+	ID       string    `json:"id"`
+	Spec     RunSpec   `json:"spec"`
+	State    string    `json:"state"`
+	Error    string    `json:"error,omitempty"`
+	Attempts []*Job    `json:"attempts"`
+	Created  time.Time `json:"created"`
+	//等待重试时的定时器
+	retryTimer *time.Timer
+}
+
+func (run *Run) job(containerID string) *Job {
+	for _, job := range run.Attempts {
+		if job.ContainerID == containerID {
+			return job
+		}
+	}
+	return nil
+}
+
+func (run *Run) attempt(n int) *Job {
+	if n < 1 || n > len(run.Attempts) {
+		return nil
+	}
+	return run.Attempts[n-1]
+}
+
+type runTable struct {
+	sync.RWMutex
+	runs        map[string]*Run
+	byContainer map[string]*Run
+}
+
+var runs = &runTable{
+	runs:        make(map[string]*Run),
+	byContainer: make(map[string]*Run),
+}
+
+func newRunID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return time.Now().Format("20060102150405.000000000")
+	}
+	return hex.EncodeToString(b)
+}
+
+func isTerminal(state string) bool {
+	switch state {
+	case RunSucceeded, RunFailed, RunKilled, RunOOM, RunLost, RunCancelled, RunFlakyPassed:
+		return true
+	}
+	return false
+}
+
+func (t *runTable) add(run *Run) {
+	t.Lock()
+	defer t.Unlock()
+	t.runs[run.ID] = run
+}
+
+func (t *runTable) attach(run *Run, containerID string) {
+	t.Lock()
+	defer t.Unlock()
+	job := &Job{
+		Attempt:     len(run.Attempts) + 1,
+		ContainerID: containerID,
+		State:       RunPending,
+	}
+	run.Attempts = append(run.Attempts, job)
+	t.byContainer[containerID] = run
+}
+
+// 返回副本,避免调用方在锁外读写
+func (t *runTable) get(id string) (Run, bool) {
+	t.RLock()
+	defer t.RUnlock()
+	run, ok := t.runs[id]
+	if !ok {
+		return Run{}, false
+	}
+	return copyRun(run), true
+}
+
+func (t *runTable) list() []Run {
+	t.RLock()
+	defer t.RUnlock()
+	list := make([]Run, 0, len(t.runs))
+	for _, run := range t.runs {
+		list = append(list, copyRun(run))
+	}
+	return list
+}
+
+func (t *runTable) setState(run *Run, state string) {
+	t.Lock()
+	defer t.Unlock()
+	run.State = state
+}
+
+// 已出队但还没结束的run,按project计数
+func (t *runTable) activeByProject() map[string]int {
+	t.RLock()
+	defer t.RUnlock()
+	active := make(map[string]int)
+	for _, run := range t.runs {
+		if run.State != RunQueued && !isTerminal(run.State) {
+			active[run.Spec.Project]++
+		}
+	}
+	return active
+}
+
+func (t *runTable) fail(run *Run, err error) {
+	t.Lock()
+	defer t.Unlock()
+	run.State = RunFailed
+	run.Error = err.Error()
+}
+
+func copyRun(run *Run) Run {
+	c := *run
+	c.Attempts = make([]*Job, 0, len(run.Attempts))
+	for _, job := range run.Attempts {
+		j := *job
+		c.Attempts = append(c.Attempts, &j)
+	}
+	return c
+}
+
+func imageRef(image, tag string) string {
+	return image + ":" + tag
+}
+
+func failRun(run *Run, err error) {
+	runs.fail(run, err)
+	publishEvent(Event{Type: "run", Action: "finish", RunID: run.ID, State: RunFailed, Time: time.Now().Unix()})
+	queue.dispatch()
+}
+
+func startRun(run *Run) {
+	image, tag := run.Spec.Image, run.Spec.Tag
+
+	//排队期间策略可能变了
+	if err := checkPullPolicy(image); err != nil {
+		failRun(run, err)
+		return
+	}
+	exists, err := localImageUsable(image, tag, run.Spec.Digest)
+	if err != nil {
+		log.Errorf("run[%s]: check image [%s:%s] exists fail:%v", run.ID, image, tag, err)
+		failRun(run, err)
+		return
+	}
+	if !exists {
+		if err := pullImage(image, tag, run.Spec.Digest); err != nil {
+			log.Errorf("run[%s]: pull image [%s:%s] fail:%v", run.ID, image, tag, err)
+			failRun(run, err)
+			return
+		}
+	} else if err := checkImageSize(image, tag, false); err != nil {
+		failRun(run, err)
+		return
+	}
+
+	startAttempt(run)
+}
+
+// 每次尝试都新建一个容器
+func startAttempt(run *Run) {
+	image, tag := run.Spec.Image, run.Spec.Tag
+	//draining之前已经定好的重试也不再开始
+	if state := WorkState(); state != StateAccepting {
+		log.Infof("run[%s]: cancelled, agent is %s", run.ID, state)
+		runs.setState(run, RunCancelled)
+		return
+	}
+
+	opts := docker.CreateContainerOptions{
+		Config: &docker.Config{
+			Image:  imageRef(image, tag),
+			Cmd:    run.Spec.Cmd,
+			Env:    run.Spec.Env,
+			Labels: map[string]string{runLabel: run.ID},
+		},
+	}
+	container, err := globalClient.CreateContainer(opts)
+	if err != nil {
+		log.Errorf("run[%s]: create container fail:%v", run.ID, err)
+		failRun(run, err)
+		return
+	}
+	//先登记容器,start事件到达时才能找到对应的run
+	runs.attach(run, container.ID)
+
+	if err := globalClient.StartContainer(container.ID, nil); err != nil {
+		log.Errorf("run[%s]: start container [%s] fail:%v", run.ID, container.ID, err)
+		failRun(run, err)
+		return
+	}
+	log.Infof("run[%s]: container [%s] started", run.ID, container.ID)
+}
+
+func CreateRun(w http.ResponseWriter, r *http.Request) error {
+	var spec RunSpec
+
+	byteContent, err := ioutil.ReadAll(r.Body)
+	defer r.Body.Close()
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(byteContent, &spec); err != nil {
+		return errjson.NewNotValidEntityError(err.Error())
+	}
+	if len(spec.Image) == 0 || len(spec.Tag) == 0 {
+		return errjson.NewNotValidEntityError("image and tag are required")
+	}
+	if err := checkPullPolicy(spec.Image); err != nil {
+		return err
+	}
+	if len(spec.Digest) != 0 && !validDigest(spec.Digest) {
+		return errjson.NewNotValidEntityError("invalid digest " + spec.Digest)
+	}
+
+	run := &Run{
+		ID:      newRunID(),
+		Spec:    spec,
+		State:   RunQueued,
+		Created: time.Now(),
+	}
+	//超出本节点的并发能力时排队等待
+	if err := queue.push(run); err != nil {
+		return err
+	}
+
+	snapshot, _ := runs.get(run.ID)
+	return writeJSON(w, r, snapshot)
+}
+
+func ListRuns(w http.ResponseWriter, r *http.Request) error {
+	return writeJSON(w, r, runs.list())
+}
+
+func GetRun(w http.ResponseWriter, r *http.Request) error {
+	id := mux.Vars(r)["id"]
+
+	run, ok := runs.get(id)
+	if !ok {
+		return errjson.NewNotFoundError("run " + id + " not found")
+	}
+	return writeJSON(w, r, run)
+}
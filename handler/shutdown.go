@@ -0,0 +1,236 @@
+package handler
+
+import (
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"test/errjson"
+)
+
+const (
+	StateAccepting    = "accepting"
+	StateDraining     = "draining"
+	StateShuttingDown = "shutting-down"
+
+	DefaultShutdownTimeout = 5 * time.Minute
+)
+
+var (
+	workLock  sync.Mutex
+	workState = StateAccepting
+	//调用方通过/drain要求排空,升级失败等内部恢复时不能撤销
+	drainRequested bool
+	//正在进行的拉取/推送等镜像操作
+	inflight int
+
+	shutdownOnce  sync.Once
+	shutdownHooks []func() error
+)
+
+// 退出前依次执行,比如从测试服务器注销
+func AddShutdownHook(fn func() error) {
+	workLock.Lock()
+	defer workLock.Unlock()
+	shutdownHooks = append(shutdownHooks, fn)
+}
+
+func WorkState() string {
+	workLock.Lock()
+	defer workLock.Unlock()
+	return workState
+}
+
+// draining或shutting-down时拒绝新的工作
+func beginWork() error {
+	workLock.Lock()
+	defer workLock.Unlock()
+	if workState != StateAccepting {
+		return errjson.NewServiceUnavailableError("agent is " + workState + ", not accepting new work")
+	}
+	inflight++
+	return nil
+}
+
+func endWork() {
+	workLock.Lock()
+	defer workLock.Unlock()
+	inflight--
+}
+
+func acceptingWork() error {
+	if state := WorkState(); state != StateAccepting {
+		return errjson.NewServiceUnavailableError("agent is " + state + ", not accepting new work")
+	}
+	return nil
+}
+
+func setWorkState(state string) bool {
+	workLock.Lock()
+	if workState == StateShuttingDown {
+		workLock.Unlock()
+		return false
+	}
+	if workState != state {
+		log.Infof("agent state %s => %s", workState, state)
+	}
+	workState = state
+	workLock.Unlock()
+
+	//恢复接收后继续执行draining期间排队的run
+	if state == StateAccepting {
+		queue.dispatch()
+	}
+	return true
+}
+
+func busy() (int, int, int) {
+	workLock.Lock()
+	ops := inflight
+	workLock.Unlock()
+
+	active := 0
+	for _, n := range runs.activeByProject() {
+		active += n
+	}
+
+	queue.Lock()
+	queued := len(queue.pending)
+	queue.Unlock()
+	return ops, active, queued
+}
+
+// 等待进行中的操作和run结束,排队的run此时不会再开始,不用等;
+// 超时后取消排队的run,并停掉剩余的run容器
+func waitIdle(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for {
+		ops, active, queued := busy()
+		if ops == 0 && active == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			log.Warnf("deadline reached with %d operation(s), %d run(s) and %d queued run(s) in flight", ops, active, queued)
+			queue.drain()
+			stopRuns()
+			return
+		}
+		log.Debugf("waiting for %d operation(s), %d run(s) and %d queued run(s)", ops, active, queued)
+		time.Sleep(500 * time.Millisecond)
+	}
+}
+
+// 不再接收新的工作,等待已有的工作完成,agent继续运行
+func Quiesce(timeout time.Duration) bool {
+	if !setWorkState(StateDraining) {
+		return false
+	}
+	waitIdle(timeout)
+	return true
+}
+
+// 停掉run的容器,之后再取消等待重试的run,包括停容器时新安排的重试
+func stopRuns() {
+	runs.RLock()
+	var ids []string
+	for id, run := range runs.byContainer {
+		if !isTerminal(run.job(id).State) {
+			ids = append(ids, id)
+		}
+	}
+	runs.RUnlock()
+
+	for _, id := range ids {
+		if err := globalClient.StopContainer(id, 10); err != nil {
+			log.Errorf("stop container [%s] fail:%v", id, err)
+		}
+	}
+
+	for _, run := range cancelRetries() {
+		log.Infof("run[%s]: retry cancelled", run.ID)
+	}
+}
+
+func GracefulShutdown(timeout time.Duration) {
+	shutdownOnce.Do(func() {
+		setWorkState(StateShuttingDown)
+		log.Infof("shutting down, wait at most %v", timeout)
+
+		//排队中的run不再执行
+		for _, run := range queue.drain() {
+			log.Infof("run[%s]: cancelled by shutdown", run.ID)
+		}
+		//退出时不再重试
+		for _, run := range cancelRetries() {
+			log.Infof("run[%s]: retry cancelled by shutdown", run.ID)
+		}
+		waitIdle(timeout)
+
+		workLock.Lock()
+		hooks := shutdownHooks
+		workLock.Unlock()
+		for _, fn := range hooks {
+			if err := fn(); err != nil {
+				log.Errorf("shutdown hook fail:%v", err)
+			}
+		}
+		log.Info("shutdown done")
+		os.Exit(0)
+	})
+}
+
+func Shutdown(w http.ResponseWriter, r *http.Request) error {
+	timeout := DefaultShutdownTimeout
+	if s := r.URL.Query().Get("timeout"); len(s) != 0 {
+		seconds, err := strconv.Atoi(s)
+		if err != nil || seconds < 0 {
+			return errjson.NewNotValidEntityError("invalid timeout " + s)
+		}
+		timeout = time.Duration(seconds) * time.Second
+	}
+
+	log.Info("recieve server's shutdown command")
+	go GracefulShutdown(timeout)
+	w.WriteHeader(http.StatusAccepted)
+	return nil
+}
+
+// 内部流程结束后恢复到之前的状态,期间调用方要求过排空时保持draining
+func restoreWorkState(prev string) {
+	workLock.Lock()
+	if drainRequested {
+		prev = StateDraining
+	}
+	workLock.Unlock()
+	setWorkState(prev)
+}
+
+func requestDrain(drain bool) bool {
+	state := StateAccepting
+	if drain {
+		state = StateDraining
+	}
+	if !setWorkState(state) {
+		return false
+	}
+	workLock.Lock()
+	drainRequested = drain
+	workLock.Unlock()
+	return true
+}
+
+func Drain(w http.ResponseWriter, r *http.Request) error {
+	if !requestDrain(true) {
+		return errjson.NewServiceUnavailableError("agent is shutting down")
+	}
+	return nil
+}
+
+func Undrain(w http.ResponseWriter, r *http.Request) error {
+	if !requestDrain(false) {
+		return errjson.NewServiceUnavailableError("agent is shutting down")
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package handler
+
+import (
+	"testing"
+	"time"
+
+	"test/errjson"
+)
+
+// draining时不接收新的run,已经排队的也不开始
+func TestDrainHoldsQueue(t *testing.T) {
+	defer resetQueue()
+	if !requestDrain(true) {
+		t.Fatal("drain refused")
+	}
+	defer func() {
+		//恢复前先清空队列,否则会去启动容器
+		resetQueue()
+		requestDrain(false)
+	}()
+
+	err := queue.push(&Run{ID: "new", State: RunQueued, Created: time.Now()})
+	if _, ok := err.(errjson.ServiceUnavailableError); !ok {
+		t.Errorf("push while draining: %v", err)
+	}
+	if _, ok := runs.get("new"); ok {
+		t.Errorf("rejected run should not be recorded")
+	}
+
+	queue.Lock()
+	queue.pending = append(queue.pending, &queueEntry{run: &Run{ID: "queued", State: RunQueued}})
+	queue.Unlock()
+	queue.dispatch()
+	if _, _, queued := busy(); queued != 1 {
+		t.Errorf("%d queued run(s) after dispatch while draining, want 1", queued)
+	}
+}
+
+func TestCancelRetries(t *testing.T) {
+	defer resetQueue()
+	started := make(chan struct{}, 1)
+	run := &Run{ID: "retrying", State: RunRetrying}
+	run.retryTimer = time.AfterFunc(time.Hour, func() { started <- struct{}{} })
+	runs.add(run)
+	runs.add(&Run{ID: "running", State: RunRunning})
+
+	cancelled := cancelRetries()
+	if len(cancelled) != 1 || cancelled[0].ID != "retrying" {
+		t.Fatalf("cancelled %v", cancelled)
+	}
+	if r, _ := runs.get("retrying"); r.State != RunCancelled {
+		t.Errorf("state %s, want %s", r.State, RunCancelled)
+	}
+	if r, _ := runs.get("running"); r.State != RunRunning {
+		t.Errorf("running run changed to %s", r.State)
+	}
+	select {
+	case <-started:
+		t.Errorf("cancelled retry still started")
+	default:
+	}
+}
+
+// draining前安排的重试到点后不再开始,也不会去创建容器
+func TestRetryCancelledWhileDraining(t *testing.T) {
+	defer resetQueue()
+	if !requestDrain(true) {
+		t.Fatal("drain refused")
+	}
+	defer requestDrain(false)
+
+	run := &Run{ID: "retrying", State: RunRetrying}
+	runs.add(run)
+	startAttempt(run)
+	if r, _ := runs.get("retrying"); r.State != RunCancelled {
+		t.Errorf("state %s, want %s", r.State, RunCancelled)
+	}
+}
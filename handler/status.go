@@ -0,0 +1,70 @@
+package handler
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	ModeRegistering = "registering"
+	ModeOnline      = "online"
+	//连不上测试服务器时,继续执行已有的run,等待服务器恢复
+	ModeOrphaned = "orphaned"
+)
+
+var (
+	modeLock  sync.RWMutex
+	agentMode = ModeRegistering
+	startedAt = time.Now()
+	//重新上线时通知事件转发,补发积压的事件
+	resumeC = make(chan struct{}, 1)
+)
+
+type AgentStatus struct {
+	Mode       string    `json:"mode"`
+	State      string    `json:"state"`
+	ActiveRuns int       `json:"active_runs"`
+	QueuedRuns int       `json:"queued_runs"`
+	MaxRuns    int       `json:"max_runs"`
+	StartedAt  time.Time `json:"started_at"`
+}
+
+func Mode() string {
+	modeLock.RLock()
+	defer modeLock.RUnlock()
+	return agentMode
+}
+
+func SetMode(mode string) {
+	modeLock.Lock()
+	old := agentMode
+	agentMode = mode
+	modeLock.Unlock()
+
+	if old == mode {
+		return
+	}
+	log.Infof("agent mode %s => %s", old, mode)
+	if mode == ModeOnline {
+		select {
+		case resumeC <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func Status() AgentStatus {
+	status := AgentStatus{
+		Mode:      Mode(),
+		State:     WorkState(),
+		StartedAt: startedAt,
+	}
+	for _, n := range runs.activeByProject() {
+		status.ActiveRuns += n
+	}
+	queue.Lock()
+	status.QueuedRuns = len(queue.pending)
+	status.MaxRuns = queue.maxRuns
+	queue.Unlock()
+	return status
+}
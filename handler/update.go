@@ -0,0 +1,87 @@
+package handler
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"sync/atomic"
+
+	"test/errjson"
+)
+
+type UpdateRequest struct {
+	Version   string `json:"version"`
+	URL       string `json:"url" validate:"required"` //测试服务器上的下载路径
+	SHA256    string `json:"sha256" validate:"required"`
+	Signature string `json:"signature,omitempty"` //base64
+}
+
+// 由main注册:下载并校验新的程序,返回安装函数,在工作排空后调用
+type Updater func(UpdateRequest) (func() error, error)
+
+var (
+	updater  Updater
+	updating int32
+)
+
+func SetUpdater(fn Updater) {
+	updater = fn
+}
+
+func UpdateAgent(w http.ResponseWriter, r *http.Request) error {
+	var req UpdateRequest
+
+	byteContent, err := ioutil.ReadAll(r.Body)
+	defer r.Body.Close()
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(byteContent, &req); err != nil {
+		return errjson.NewNotValidEntityError(err.Error())
+	}
+	if len(req.URL) == 0 {
+		return errjson.NewNotValidEntityError("url is required")
+	}
+	if sum, err := hex.DecodeString(req.SHA256); err != nil || len(sum) != 32 {
+		return errjson.NewNotValidEntityError("invalid sha256 " + req.SHA256)
+	}
+	if updater == nil {
+		return errjson.NewInternalServerError("self update is not supported")
+	}
+	if err := acceptingWork(); err != nil {
+		return err
+	}
+	if !atomic.CompareAndSwapInt32(&updating, 0, 1) {
+		return errjson.NewServiceUnavailableError("another update is in progress")
+	}
+
+	install, err := updater(req)
+	if err != nil {
+		atomic.StoreInt32(&updating, 0)
+		log.Errorf("prepare update to %s fail:%v", req.Version, err)
+		return err
+	}
+
+	prev := WorkState()
+	go func() {
+		defer atomic.StoreInt32(&updating, 0)
+
+		log.Infof("update to %s: draining", req.Version)
+		if !Quiesce(DefaultShutdownTimeout) {
+			return
+		}
+		//exec之后队列就没了,排队的run先取消
+		for _, run := range queue.drain() {
+			log.Infof("run[%s]: cancelled by update", run.ID)
+		}
+		//安装成功会直接exec新的程序,不会返回
+		if err := install(); err != nil {
+			log.Errorf("install update %s fail:%v", req.Version, err)
+			restoreWorkState(prev)
+		}
+	}()
+
+	w.WriteHeader(http.StatusAccepted)
+	return nil
+}
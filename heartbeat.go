@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"test/handler"
+)
+
+const maxHeartbeatBackoff = time.Minute
+
+// 服务器不认识本节点(比如服务器重启过),需要重新注册
+var errNotRegistered = errors.New("agent is not registered on server")
+
+type Heartbeat struct {
+	NodeID     string              `json:"node_id"`
+	ListenPort string              `json:"listen_port"`
+	Status     handler.AgentStatus `json:"status"`
+}
+
+func SendHeartbeat(ip string, port string) error {
+	client := new(BaseClient)
+	client.Opts = new(ClientOpts)
+	client.Opts.Url = serverURL(ip, port)
+	client.Opts.Timeout = time.Duration(3 * time.Second)
+	client.Opts.Identity = Identity
+	client.Opts.Transport = Certs.Transport()
+
+	data, err := json.Marshal(Heartbeat{NodeID: Identity.ID(), ListenPort: ListenPort, Status: handler.Status()})
+	if err != nil {
+		return err
+	}
+	resp, err := client.DoPost("/heartbeat", data)
+
+	defer func() {
+		if resp != nil {
+			resp.Body.Close()
+		}
+	}()
+	if err != nil {
+		return err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusNotFound, http.StatusGone:
+		return errNotRegistered
+	}
+	return fmt.Errorf("heartbeat fail: %s", resp.Status)
+}
+
+func heartbeatBackoff(failures int) time.Duration {
+	d := heartbeatInterval()
+	for i := 1; i < failures && d < maxHeartbeatBackoff; i++ {
+		d *= 2
+	}
+	if d > maxHeartbeatBackoff {
+		d = maxHeartbeatBackoff
+	}
+	return d
+}
+
+// 注册并保持心跳.连续失败超过HeartbeatFailures次进入orphaned模式,
+// 已有的run继续执行,服务器恢复后重新注册
+func keepAlive() {
+	registered := false
+	failures := 0
+
+	for {
+		var err error
+		if !registered {
+			var cfg *AgentConfig
+			cfg, err = register(ServerIP, ServerPort)
+			if err == nil {
+				if err = applyConfig(cfg); err != nil {
+					err = rejectedError{err}
+				}
+			}
+			if err == nil {
+				registered = true
+				log.Infof("registered to test server %s:%s", ServerIP, ServerPort)
+			} else {
+				log.Errorf("can not register to test server for :%v", err)
+				confirmUpdate(err)
+			}
+		} else {
+			err = SendHeartbeat(ServerIP, ServerPort)
+			if err == errNotRegistered {
+				log.Warn("test server lost our registration, register again")
+				registered = false
+				continue
+			}
+			confirmUpdate(err)
+		}
+
+		if err == nil {
+			failures = 0
+			handler.SetMode(handler.ModeOnline)
+			time.Sleep(heartbeatInterval())
+			continue
+		}
+
+		failures++
+		log.Debugf("heartbeat fail(%d/%d): %v", failures, HeartbeatFailures, err)
+		if failures >= HeartbeatFailures && handler.Mode() != handler.ModeOrphaned {
+			log.Warnf("lost test server after %d failures, running orphaned", failures)
+			handler.SetMode(handler.ModeOrphaned)
+			//服务器恢复后需要重新注册,拿到最新的配置
+			registered = false
+		}
+		time.Sleep(heartbeatBackoff(failures))
+	}
+}
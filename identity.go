@@ -0,0 +1,98 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+)
+
+const (
+	AgentIDHeader    = "X-Agent-Id"
+	AgentTokenHeader = "X-Agent-Token"
+)
+
+// 节点的固定身份,保存在本地状态文件里,重启或IP变化后保持不变
+type AgentIdentity struct {
+	sync.RWMutex
+	path   string
+	NodeID string `json:"node_id"`
+	Token  string `json:"token,omitempty"`
+}
+
+func newNodeID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s-%s-%s-%s-%s", hex.EncodeToString(b[0:4]), hex.EncodeToString(b[4:6]),
+		hex.EncodeToString(b[6:8]), hex.EncodeToString(b[8:10]), hex.EncodeToString(b[10:])), nil
+}
+
+// 状态文件不存在时生成新的node ID
+func LoadIdentity(path string) (*AgentIdentity, error) {
+	id := &AgentIdentity{path: path}
+
+	byteContent, err := ioutil.ReadFile(path)
+	if err == nil {
+		if err := json.Unmarshal(byteContent, id); err != nil {
+			return nil, fmt.Errorf("invalid state file %s: %v", path, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if len(id.NodeID) != 0 {
+		return id, nil
+	}
+	if id.NodeID, err = newNodeID(); err != nil {
+		return nil, err
+	}
+	if err := id.save(); err != nil {
+		return nil, err
+	}
+	return id, nil
+}
+
+// 调用方需持有锁
+func (id *AgentIdentity) save() error {
+	byteContent, err := json.MarshalIndent(id, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := id.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, byteContent, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, id.path)
+}
+
+func (id *AgentIdentity) ID() string {
+	id.RLock()
+	defer id.RUnlock()
+	return id.NodeID
+}
+
+// 首次注册时服务器下发token,之后每次通信都要带上
+func (id *AgentIdentity) SetToken(token string) error {
+	id.Lock()
+	defer id.Unlock()
+	if token == id.Token {
+		return nil
+	}
+	id.Token = token
+	return id.save()
+}
+
+func (id *AgentIdentity) apply(req *http.Request) {
+	id.RLock()
+	defer id.RUnlock()
+	req.Header.Set(AgentIDHeader, id.NodeID)
+	if len(id.Token) != 0 {
+		req.Header.Set(AgentTokenHeader, id.Token)
+	}
+}
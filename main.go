@@ -1,6 +1,10 @@
 package main
 
 import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
@@ -8,32 +12,90 @@ import (
 	"net/http"
 	"os"
 	"os/exec"
+	"os/signal"
 	"regexp"
+	"strings"
+	"sync/atomic"
+	"syscall"
 	"test/handler"
 	"test/routers"
 	"time"
 
 	"test/Godeps/_workspace/src/github.com/Sirupsen/logrus"
-	docker "test/Godeps/_workspace/src/github.com/fsouza/go-dockerclient"
 )
 
 var (
-	ServerIP     string
-	ServerPort   string
-	ListenPort   string
-	RegistryIp   string
-	RegistryPort string
-	log          = logrus.New()
-	logFile      = "./log_debug.log"
+	ServerIP          string
+	ServerPort        string
+	ListenPort        string
+	RegistryIp        string
+	RegistryPort      string
+	MaxRuns           int
+	HeartbeatFailures int
+	ReverseConnect    bool
+	ShutdownTimeout   time.Duration
+	UpdateKeyFile     string
+	AccessKey         string
+	SecretKey         string
+	ListenTLS         bool
+	MutualTLS         bool
+	ServerTLS         bool
+	TLSCertFile       string
+	TLSKeyFile        string
+	TLSCAFile         string
+	CredentialFile    string
+	CredentialKeyFile string
+	Docker            handler.DockerEndpoint
+	AuditLog          string
+	AuditKeyFile      string
+	AccessLogFile     string
+	Labels            = make(map[string]string)
+	StateFile         string
+	Identity          *AgentIdentity
+	log               = logrus.New()
+	logFile           = "./log_debug.log"
+
+	heartbeatNanos = int64(1 * time.Second)
 )
 
-func register(ip string, port string) (string, error) {
+type AgentLimits struct {
+	MaxRuns int `json:"max_runs"`
+}
+
+// 注册成功后,测试服务器下发的配置
+type AgentConfig struct {
+	Token             string                  `json:"token,omitempty"`
+	Registry          string                  `json:"registry"`
+	Registries        *handler.RegistryConfig `json:"registries,omitempty"`
+	Credentials       *handler.UserInfo       `json:"credentials,omitempty"`
+	AccessKeys        []handler.AccessKey     `json:"access_keys"`
+	Certificate       *CertBundle             `json:"certificate,omitempty"`
+	Policy            *handler.Policy         `json:"policy,omitempty"`
+	HeartbeatInterval int                     `json:"heartbeat_interval"` //秒
+	Limits            AgentLimits             `json:"limits"`
+}
+
+func register(ip string, port string) (*AgentConfig, error) {
 	client := new(BaseClient)
 	client.Opts = new(ClientOpts)
-	client.Opts.Url = "http://" + ip + ":" + port
+	client.Opts.Url = serverURL(ip, port)
 	client.Opts.Timeout = time.Duration(10 * time.Second)
+	client.Opts.Identity = Identity
+	client.Opts.Transport = Certs.Transport()
 
-	resp, err := client.DoAction("/register/"+ListenPort, Get)
+	node, err := handler.CollectNodeInfo(ListenPort, Labels)
+	if err != nil {
+		return nil, fmt.Errorf("collect node info fail: %v", err)
+	}
+	node.NodeID = Identity.ID()
+	node.Reverse = ReverseConnect
+	node.Version = Version
+	data, err := json.Marshal(node)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.DoPost("/register", data)
 
 	defer func() {
 		if resp != nil {
@@ -41,27 +103,125 @@ func register(ip string, port string) (string, error) {
 		}
 	}()
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	byteContent, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 400 && resp.StatusCode < 500 {
+		return nil, rejectedError{fmt.Errorf("register rejected: %s %s", resp.Status, string(byteContent))}
 	}
 	if resp.StatusCode != http.StatusOK {
-		err = errors.New("register fail")
+		return nil, fmt.Errorf("register fail: %s %s", resp.Status, string(byteContent))
+	}
+
+	cfg := new(AgentConfig)
+	if err := json.Unmarshal(byteContent, cfg); err != nil {
+		return nil, fmt.Errorf("invalid agent config: %v", err)
+	}
+	return cfg, nil
+}
+
+func deregister(ip string, port string) error {
+	client := new(BaseClient)
+	client.Opts = new(ClientOpts)
+	client.Opts.Url = serverURL(ip, port)
+	client.Opts.Timeout = time.Duration(10 * time.Second)
+	client.Opts.Identity = Identity
+	client.Opts.Transport = Certs.Transport()
+
+	data, err := json.Marshal(Heartbeat{NodeID: Identity.ID(), ListenPort: ListenPort, Status: handler.Status()})
+	if err != nil {
+		return err
+	}
+	resp, err := client.DoPost("/deregister", data)
+
+	defer func() {
+		if resp != nil {
+			resp.Body.Close()
+		}
+	}()
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("deregister fail: %s", resp.Status)
+	}
+	log.Info("deregistered from test server")
+	return nil
+}
+
+func applyConfig(cfg *AgentConfig) error {
+	if len(cfg.Token) != 0 {
+		if err := Identity.SetToken(cfg.Token); err != nil {
+			return fmt.Errorf("save enrollment token fail: %v", err)
+		}
+	}
+	if cfg.Registries != nil {
+		if err := handler.SetRegistries(*cfg.Registries); err != nil {
+			return err
+		}
+		cfg.Registry = cfg.Registries.Primary.Address
 	} else {
-		byteContent, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			return "", err
+		if len(cfg.Registry) == 0 {
+			return errors.New("server doesn't set registry")
 		}
-		return string(byteContent), nil
+		handler.SetRegistry(cfg.Registry)
+	}
+	if cfg.Registry != (RegistryIp + ":" + RegistryPort) {
+		log.Warnf("registry %s:%s overridden by server's registry %s", RegistryIp, RegistryPort, cfg.Registry)
 	}
-	return "", err
+
+	if cfg.Credentials != nil {
+		handler.SetCredentials(*cfg.Credentials)
+	}
+	if cfg.Policy != nil {
+		if err := handler.SetPolicy(*cfg.Policy); err != nil {
+			return fmt.Errorf("invalid policy: %v", err)
+		}
+	}
+	if cfg.Certificate != nil {
+		if err := Certs.Install(cfg.Certificate); err != nil {
+			return fmt.Errorf("install certificate fail: %v", err)
+		}
+	}
+	//启动参数里的key始终有效,便于注册前访问
+	keys := cfg.AccessKeys
+	if len(AccessKey) != 0 {
+		keys = append(keys, handler.AccessKey{AccessKey: AccessKey, SecretKey: SecretKey})
+	}
+	handler.SetAccessKeys(keys)
+	if cfg.HeartbeatInterval > 0 {
+		setHeartbeatInterval(time.Duration(cfg.HeartbeatInterval) * time.Second)
+	}
+	if cfg.Limits.MaxRuns > 0 {
+		handler.SetMaxRuns(cfg.Limits.MaxRuns)
+	}
+	log.Infof("apply server config: registry[%s] heartbeat[%ds] maxruns[%d]", cfg.Registry, cfg.HeartbeatInterval, cfg.Limits.MaxRuns)
+	return nil
+}
+
+func heartbeatInterval() time.Duration {
+	return time.Duration(atomic.LoadInt64(&heartbeatNanos))
 }
 
-func HealthCheck(ip string, port string) error {
+func setHeartbeatInterval(d time.Duration) {
+	atomic.StoreInt64(&heartbeatNanos, int64(d))
+}
+
+func ForwardEvent(e handler.Event) error {
 	client := new(BaseClient)
 	client.Opts = new(ClientOpts)
-	client.Opts.Url = "http://" + ip + ":" + port
-	client.Opts.Timeout = time.Duration(1 * time.Second)
+	client.Opts.Url = serverURL(ServerIP, ServerPort)
+	client.Opts.Identity = Identity
+	client.Opts.Transport = Certs.Transport()
 
-	resp, err := client.DoAction("/", Get)
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	resp, err := client.DoPost("/events", data)
 
 	defer func() {
 		if resp != nil {
@@ -71,6 +231,9 @@ func HealthCheck(ip string, port string) error {
 	if err != nil {
 		return err
 	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("forward event fail: %s", resp.Status)
+	}
 	return nil
 }
 
@@ -80,14 +243,12 @@ func ConfigRegistry(Registry string) error {
 		log.Errorf("doesn't set registry")
 		return errors.New("registry is empty ")
 	}
-
-	endpoint := "unix://var/run/docker.sock"
-	client, err := docker.NewClient(endpoint)
-	if err != nil {
-		panic(err)
+	//改的是本机的docker配置并重启本机的docker
+	if !handler.DockerIsLocal() {
+		return errors.New("can not config registry on a remote docker daemon, set --insecure-registry on it")
 	}
 
-	envs, err := client.Version()
+	envs, err := handler.Docker().Version()
 	if err != nil {
 		log.Errorf("get docker version fail:%v", err)
 		return err
@@ -178,62 +339,190 @@ func ConfigRegistry(Registry string) error {
 	return err
 }
 
-func main() {
-	go func() {
-		for {
-			err := HealthCheck(ServerIP, ServerPort)
-			if err != nil {
-				log.Debugf("healthy checking ....")
-				os.Exit(1)
-			}
-			time.Sleep(1 * time.Second)
-		}
-	}()
-	go func() {
-		/*
-			err := ConfigRegistry(RegistryIp + ":" + RegistryPort)
-			if err != nil {
-				panic("fail to config registry:" + err.Error())
-			}
-		*/
+// 没有指定-docker时,和docker命令一样先看DOCKER_HOST
+func dockerHost() string {
+	if host := os.Getenv("DOCKER_HOST"); len(host) != 0 {
+		return host
+	}
+	return handler.DefaultDockerEndpoint
+}
 
-		//注册时,从上层服务器获取到registry(IP:Port)
-		//注意,要开放防火墙端口
-		registryHost, err := register(ServerIP, ServerPort)
+func main() {
+	/*
+		err := ConfigRegistry(RegistryIp + ":" + RegistryPort)
 		if err != nil {
-			log.Fatalf("can not register to test server for :%v", err)
-
+			panic("fail to config registry:" + err.Error())
 		}
-		if registryHost != (RegistryIp + ":" + RegistryPort) {
-			log.Fatalf("registry doesn't match server's registry")
-		}
-		go func() {
+	*/
+
+	//注册时,从上层服务器获取到registry(IP:Port),之后保持心跳
+	//注意,要开放防火墙端口;使用-reverse时由agent主动连接,不需要开放
+	checkUpdate()
+	if err := handler.ConnectDocker(Docker); err != nil {
+		//只有配置错误会走到这里,daemon连不上时降级运行
+		log.Fatal(err)
+	}
+	handler.SetUpdater(prepareUpdate)
+	//本机docker客户端已有的登录信息作为后备
+	if err := handler.LoadDockerConfig(); err != nil {
+		log.Warnf("load docker config fail:%v", err)
+	}
+	go keepAlive()
 
-		}()
+	handler.AddShutdownHook(func() error {
+		return deregister(ServerIP, ServerPort)
+	})
+	sigC := make(chan os.Signal, 1)
+	signal.Notify(sigC, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		sig := <-sigC
+		log.Infof("receive signal %v", sig)
+		handler.GracefulShutdown(ShutdownTimeout)
 	}()
+
+	//容器状态变化同步给run,并上报给测试服务器
+	handler.SetEventForwarder(ForwardEvent)
+	go handler.WatchEvents()
+	//注册下发的证书在过期前续期
+	go Certs.KeepFresh()
+
 	log.Info("router..")
 	router := routers.NewRouter()
+	if ReverseConnect {
+		log.Infof("reverse connecting to %s:%s", ServerIP, ServerPort)
+		NewTunnel(ServerIP, ServerPort, router).Run()
+		return
+	}
 	log.Info("listening on " + ListenPort)
-	err := http.ListenAndServe(":"+ListenPort, router)
+	var err error
+	if ListenTLS {
+		server := &http.Server{
+			Addr:      ":" + ListenPort,
+			Handler:   router,
+			TLSConfig: Certs.ServerConfig(),
+		}
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		err = http.ListenAndServe(":"+ListenPort, router)
+	}
 	if err != nil {
 		log.Fatal(err)
 	}
 }
 
+// 审计日志的HMAC密钥,第一次启动时生成
+func loadAuditKey(path string) ([]byte, error) {
+	key, err := ioutil.ReadFile(path)
+	if err == nil {
+		key = bytes.TrimSpace(key)
+		if len(key) < 16 {
+			return nil, fmt.Errorf("audit key in %s is too short", path)
+		}
+		return key, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return nil, err
+	}
+	key = []byte(hex.EncodeToString(raw))
+	if err := ioutil.WriteFile(path, key, 0600); err != nil {
+		return nil, err
+	}
+	log.Infof("audit key generated in %s", path)
+	return key, nil
+}
+
 func init() {
 	flag.StringVar(&ServerIP, "sip", "", "server ip")
 	flag.StringVar(&ServerPort, "sport", "", "server port")
 	flag.StringVar(&ListenPort, "lport", "", "listen port")
 	flag.StringVar(&RegistryIp, "rip", "", "registry ip")
 	flag.StringVar(&RegistryPort, "rport", "", "registry port")
+	flag.IntVar(&MaxRuns, "maxruns", 4, "max concurrent runs on this node")
+	flag.IntVar(&HeartbeatFailures, "hbfailures", 3, "heartbeat failures before running orphaned")
+	flag.DurationVar(&ShutdownTimeout, "shutdowntimeout", handler.DefaultShutdownTimeout, "max time to wait for in-flight work on shutdown")
+	flag.BoolVar(&ReverseConnect, "reverse", false, "dial the server instead of listening on lport")
+	flag.StringVar(&StateFile, "state", "./agent_state.json", "file keeping the node ID and enrollment token")
+	flag.StringVar(&UpdateKeyFile, "updatekey", "", "PEM public key verifying self-update signatures")
+	flag.StringVar(&AccessKey, "accesskey", "", "access key accepted on the agent API")
+	flag.StringVar(&SecretKey, "secretkey", "", "secret key of -accesskey")
+	flag.BoolVar(&ListenTLS, "tls", false, "serve the agent API over TLS")
+	flag.BoolVar(&MutualTLS, "mtls", false, "require client certificates signed by -tlsca")
+	flag.BoolVar(&ServerTLS, "servertls", false, "use https to the test server")
+	flag.StringVar(&TLSCertFile, "tlscert", "./agent.crt", "agent certificate")
+	flag.StringVar(&TLSKeyFile, "tlskey", "./agent.key", "agent private key")
+	flag.StringVar(&TLSCAFile, "tlsca", "./ca.crt", "CA bundle verifying the server and clients")
+	flag.StringVar(&CredentialFile, "credfile", "./credentials.enc", "encrypted registry credentials, used with -credkey")
+	flag.StringVar(&CredentialKeyFile, "credkey", "", "file holding the key that encrypts -credfile, empty to keep credentials in memory only")
+	flag.StringVar(&Docker.Endpoint, "docker", dockerHost(), "docker endpoint, unix:// or tcp://")
+	flag.StringVar(&Docker.TLSCert, "dockercert", "", "client certificate for a tcp:// docker endpoint")
+	flag.StringVar(&Docker.TLSKey, "dockerkey", "", "client key for a tcp:// docker endpoint")
+	flag.StringVar(&Docker.TLSCA, "dockerca", "", "CA verifying a tcp:// docker endpoint")
+	flag.StringVar(&Docker.APIVersion, "dockerapi", "", "pin the docker API version, e.g. 1.21; older daemons are rejected")
+	flag.StringVar(&AuditLog, "auditlog", "./audit.log", "audit log of mutating requests, JSON lines")
+	flag.StringVar(&AuditKeyFile, "auditkey", "./audit.key", "HMAC key chaining -auditlog, created if missing; keep it away from the log")
+	flag.StringVar(&AccessLogFile, "accesslog", "", "access log of all requests, JSON lines; empty logs to the debug log")
+	labels := flag.String("labels", "", "node labels, k1=v1,k2=v2")
 
 	flag.Parse()
 
+	for _, kv := range strings.Split(*labels, ",") {
+		if len(kv) == 0 {
+			continue
+		}
+		pair := strings.SplitN(kv, "=", 2)
+		if len(pair) != 2 {
+			panic("invalid label: " + kv)
+		}
+		Labels[pair[0]] = pair[1]
+	}
+
 	if len(ServerIP) == 0 || len(ServerPort) == 0 || len(ListenPort) == 0 || len(RegistryIp) == 0 || len(RegistryPort) == 0 {
 		panic("invalid argument")
 	}
 	handler.SetRegistry(RegistryIp + ":" + RegistryPort)
 
+	identity, err := LoadIdentity(StateFile)
+	if err != nil {
+		panic("load agent identity fail: " + err.Error())
+	}
+	Identity = identity
+	if err := Certs.Load(); err != nil {
+		panic("load certificates fail: " + err.Error())
+	}
+	//没有CA时crypto/tls会用系统根证书校验客户端,任何公共CA签发的证书都能通过
+	if MutualTLS && !Certs.HasCA() {
+		panic("-mtls requires a CA bundle in " + TLSCAFile)
+	}
+	if len(CredentialKeyFile) != 0 {
+		secret, err := ioutil.ReadFile(CredentialKeyFile)
+		if err != nil {
+			panic("read credential key fail: " + err.Error())
+		}
+		if err := handler.PersistCredentials(CredentialFile, bytes.TrimSpace(secret)); err != nil {
+			panic("load credentials fail: " + err.Error())
+		}
+	}
+	auditKey, err := loadAuditKey(AuditKeyFile)
+	if err != nil {
+		panic("load audit key fail: " + err.Error())
+	}
+	if err := handler.SetAuditLog(AuditLog, auditKey); err != nil {
+		panic("open audit log fail: " + err.Error())
+	}
+	if len(AccessLogFile) != 0 {
+		if err := handler.SetAccessLog(AccessLogFile); err != nil {
+			panic("open access log fail: " + err.Error())
+		}
+	}
+	handler.SetMaxRuns(MaxRuns)
+	if len(AccessKey) != 0 {
+		handler.SetAccessKeys([]handler.AccessKey{{AccessKey: AccessKey, SecretKey: SecretKey}})
+	}
+
 	log.Formatter = &logrus.TextFormatter{DisableColors: true}
 	fp, err := os.OpenFile(logFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
 	if err != nil {
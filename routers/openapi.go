@@ -0,0 +1,294 @@
+package routers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"test/errjson"
+	"test/handler"
+)
+
+// OpenAPI 3里用到的schema子集
+type Schema struct {
+	Type                 string             `json:"type,omitempty"`
+	Format               string             `json:"format,omitempty"`
+	Pattern              string             `json:"pattern,omitempty"`
+	Nullable             bool               `json:"nullable,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	AdditionalProperties interface{}        `json:"additionalProperties,omitempty"`
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// 由Go类型生成schema;带validate:"required"标签的字段是必填的
+func schemaOf(t reflect.Type) *Schema {
+	switch {
+	case t == nil:
+		return &Schema{}
+	case t == timeType:
+		return &Schema{Type: "string", Format: "date-time"}
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		s := schemaOf(t.Elem())
+		s.Nullable = true
+		return s
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &Schema{Type: "integer"}
+	case reflect.Float32, reflect.Float64:
+		return &Schema{Type: "number"}
+	case reflect.String:
+		return &Schema{Type: "string"}
+	case reflect.Slice, reflect.Array:
+		return &Schema{Type: "array", Items: schemaOf(t.Elem()), Nullable: t.Kind() == reflect.Slice}
+	case reflect.Map:
+		return &Schema{Type: "object", AdditionalProperties: schemaOf(t.Elem())}
+	case reflect.Struct:
+		s := &Schema{Type: "object", Properties: make(map[string]*Schema), AdditionalProperties: false}
+		addFields(s, t)
+		return s
+	}
+	//interface{}等任意类型
+	return &Schema{}
+}
+
+func addFields(s *Schema, t reflect.Type) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Anonymous && f.Type.Kind() == reflect.Struct {
+			addFields(s, f.Type)
+			continue
+		}
+		if len(f.PkgPath) != 0 {
+			continue
+		}
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if len(name) == 0 {
+			name = f.Name
+		}
+		s.Properties[name] = schemaOf(f.Type)
+		if f.Tag.Get("validate") == "required" {
+			s.Required = append(s.Required, name)
+		}
+	}
+}
+
+func typeOf(v interface{}) reflect.Type {
+	if v == nil {
+		return nil
+	}
+	return reflect.TypeOf(v)
+}
+
+// 按schema检查解码后的JSON,返回第一个错误
+func validate(s *Schema, v interface{}, path string) error {
+	if v == nil {
+		if s.Nullable || len(s.Type) == 0 {
+			return nil
+		}
+		return fmt.Errorf("%s: null is not allowed", path)
+	}
+	switch s.Type {
+	case "object":
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s: expect object", path)
+		}
+		for _, name := range s.Required {
+			if value, ok := m[name]; !ok || value == nil || value == "" {
+				return fmt.Errorf("%s: %s is required", path, name)
+			}
+		}
+		keys := make([]string, 0, len(m))
+		for k := range m {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if prop, ok := s.Properties[k]; ok {
+				if err := validate(prop, m[k], path+"."+k); err != nil {
+					return err
+				}
+			} else if extra, ok := s.AdditionalProperties.(*Schema); ok {
+				if err := validate(extra, m[k], path+"."+k); err != nil {
+					return err
+				}
+			} else if s.AdditionalProperties == false {
+				return fmt.Errorf("%s: unknown field %s", path, k)
+			}
+		}
+	case "array":
+		list, ok := v.([]interface{})
+		if !ok {
+			return fmt.Errorf("%s: expect array", path)
+		}
+		for i, item := range list {
+			if err := validate(s.Items, item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+	case "string":
+		if _, ok := v.(string); !ok {
+			return fmt.Errorf("%s: expect string", path)
+		}
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			return fmt.Errorf("%s: expect boolean", path)
+		}
+	case "integer":
+		n, ok := v.(json.Number)
+		if !ok {
+			return fmt.Errorf("%s: expect integer", path)
+		}
+		if _, err := n.Int64(); err != nil {
+			return fmt.Errorf("%s: expect integer, got %s", path, n)
+		}
+	case "number":
+		if _, ok := v.(json.Number); !ok {
+			return fmt.Errorf("%s: expect number", path)
+		}
+	}
+	return nil
+}
+
+// 请求body先按route声明的Request校验,失败返回422
+func validated(request interface{}, h http.Handler) http.Handler {
+	schema := schemaOf(typeOf(request))
+	return handler.JsonReturnHandler(func(w http.ResponseWriter, r *http.Request) error {
+		byteContent, err := ioutil.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			return err
+		}
+		var v interface{}
+		decoder := json.NewDecoder(bytes.NewReader(byteContent))
+		decoder.UseNumber()
+		if err := decoder.Decode(&v); err != nil {
+			return errjson.NewNotValidEntityError("invalid JSON body: " + err.Error())
+		}
+		if err := validate(schema, v, "body"); err != nil {
+			return errjson.NewNotValidEntityError(err.Error())
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(byteContent))
+		h.ServeHTTP(w, r)
+		return nil
+	})
+}
+
+var pathVar = regexp.MustCompile(`\{([^:}]+)(:([^}]*))?\}`)
+
+func envelopeSchema(data *Schema) *Schema {
+	s := schemaOf(reflect.TypeOf(handler.Envelope{}))
+	if data != nil {
+		s.Properties["data"] = data
+	}
+	return s
+}
+
+func operation(route Route) map[string]interface{} {
+	op := map[string]interface{}{
+		"operationId": strings.ToLower(route.Method) + strings.Replace(pathVar.ReplaceAllString(route.Pattern, "_$1"), "/", "_", -1),
+		"tags":        []string{route.Name},
+	}
+	if route.Public {
+		op["security"] = []interface{}{}
+	} else {
+		perm := route.Permission
+		if len(perm) == 0 {
+			perm = handler.PermAdmin
+		}
+		op["x-permission"] = perm
+	}
+
+	var params []interface{}
+	for _, m := range pathVar.FindAllStringSubmatch(route.Pattern, -1) {
+		s := &Schema{Type: "string"}
+		if len(m[3]) != 0 {
+			s.Pattern = "^" + m[3] + "$"
+		}
+		params = append(params, map[string]interface{}{"name": m[1], "in": "path", "required": true, "schema": s})
+	}
+	if len(params) != 0 {
+		op["parameters"] = params
+	}
+
+	if route.Request != nil {
+		op["requestBody"] = map[string]interface{}{
+			"required": true,
+			"content":  map[string]interface{}{"application/json": map[string]interface{}{"schema": schemaOf(typeOf(route.Request))}},
+		}
+	}
+
+	success := map[string]interface{}{"description": "success"}
+	if len(route.Produces) != 0 {
+		success["content"] = map[string]interface{}{route.Produces: map[string]interface{}{"schema": &Schema{Type: "string", Format: "binary"}}}
+	} else {
+		var data *Schema
+		if route.Response != nil {
+			data = schemaOf(typeOf(route.Response))
+		}
+		success["content"] = map[string]interface{}{"application/json": map[string]interface{}{"schema": envelopeSchema(data)}}
+	}
+	failure := map[string]interface{}{
+		"description": "error, see error.status and error.code",
+		"content":     map[string]interface{}{"application/json": map[string]interface{}{"schema": envelopeSchema(nil)}},
+	}
+	op["responses"] = map[string]interface{}{"200": success, "default": failure}
+	return op
+}
+
+// 只描述/v1下的接口,旧接口已废弃
+func OpenAPI() map[string]interface{} {
+	paths := make(map[string]map[string]interface{})
+	for _, route := range routes {
+		p := "/" + handler.APIVersion + pathVar.ReplaceAllString(route.Pattern, "{$1}")
+		if paths[p] == nil {
+			paths[p] = make(map[string]interface{})
+		}
+		paths[p][strings.ToLower(route.Method)] = operation(route)
+	}
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "autotest agent API",
+			"version": handler.APIVersion,
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"securitySchemes": map[string]interface{}{
+				"basic": map[string]interface{}{"type": "http", "scheme": "basic"},
+				"hmac":  map[string]interface{}{"type": "apiKey", "in": "header", "name": handler.AuthSignatureHeader},
+			},
+		},
+		"security": []interface{}{
+			map[string]interface{}{"basic": []string{}},
+			map[string]interface{}{"hmac": []string{}},
+		},
+	}
+}
+
+func serveOpenAPI(w http.ResponseWriter, r *http.Request) {
+	byteContent, err := json.Marshal(OpenAPI())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(byteContent)
+}
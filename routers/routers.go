@@ -3,6 +3,7 @@ package routers
 import (
 	"net/http"
 	"test/handler"
+	"time"
 
 	"test/Godeps/_workspace/src/github.com/gorilla/mux"
 )
@@ -14,6 +15,45 @@ type Route struct {
 	Method  string
 	Pattern string
 	Handler http.Handler
+	//不需要认证即可访问
+	Public bool
+	//非空时记录审计日志
+	Action string
+	//调用方需要的权限
+	Permission string
+	//请求body和返回data的类型,用于生成OpenAPI文档和校验请求
+	Request  interface{}
+	Response interface{}
+	//不返回JSON的接口,比如下载文件
+	Produces string
+	//0使用默认值,<0不限制;拉取镜像、输出日志等耗时的接口不限制时间
+	Timeout     time.Duration
+	MaxBodySize int64
+}
+
+const (
+	defaultTimeout = 30 * time.Second
+	noLimit        = -1
+)
+
+// 所有接口共用的中间件,V1/Deprecated在recover里面,出错时也按对应格式返回
+func chain(route Route, version handler.Middleware, h http.Handler) http.Handler {
+	timeout := route.Timeout
+	if timeout == 0 {
+		timeout = defaultTimeout
+	}
+	maxBody := route.MaxBodySize
+	if maxBody == 0 {
+		maxBody = handler.DefaultMaxBodySize
+	}
+	return handler.Chain(h,
+		handler.RequestIDs,
+		handler.AccessLog,
+		handler.Recover,
+		version,
+		handler.LimitBody(maxBody),
+		handler.Timeout(timeout),
+	)
 }
 
 func NewRouter() *mux.Router {
@@ -24,15 +64,40 @@ func NewRouter() *mux.Router {
 	//router.Handle()
 
 	for _, route := range routes {
+		h := route.Handler
+		if route.Request != nil {
+			h = validated(route.Request, h)
+		}
+		if !route.Public {
+			//漏写Permission的接口不能悄悄变成admin
+			if len(route.Permission) == 0 {
+				panic("route " + route.Method + " " + route.Pattern + " has no permission")
+			}
+			h = handler.RequireAuth(route.Permission, h)
+		}
+		if len(route.Action) != 0 {
+			h = handler.Audit(route.Action, h)
+		}
 		//同时存在HandlerFunc、Handler会有什么问题?
 		//哪个在后面，哪个被设置
+		router.
+			Methods(route.Method).
+			Path("/" + handler.APIVersion + route.Pattern).
+			Name(route.Name).
+			Handler(chain(route, handler.V1, h))
+		//旧的接口保留兼容
 		router.
 			Methods(route.Method).
 			Path(route.Pattern).
 			Name(route.Name).
-			Handler(route.Handler)
+			Handler(chain(route, handler.Deprecated, h))
 		//router.Handle
 	}
+	//文档由routes生成,不能放进routes里;接口列表和image一样需要读权限
+	openapi := handler.Chain(handler.RequireAuth(handler.PermImagesRead, http.HandlerFunc(serveOpenAPI)),
+		handler.RequestIDs, handler.AccessLog, handler.Recover)
+	router.Methods("GET").Path("/openapi.json").Handler(openapi)
+	router.Methods("GET").Path("/" + handler.APIVersion + "/openapi.json").Handler(openapi)
 	return router
 }
 
@@ -55,56 +120,256 @@ var routes = Routes{
 		},
 	*/
 	Route{
-		Name:    "Images",
-		Pattern: "/list",
-		Method:  "GET",
-		Handler: handler.JsonReturnHandler(handler.ListImages),
+		Name:     "host",
+		Pattern:  "/health",
+		Method:   "GET",
+		Handler:  handler.JsonReturnHandler(handler.Health),
+		Response: map[string]string{},
+		Public:   true,
+	},
+
+	Route{
+		Name:       "Images",
+		Pattern:    "/list",
+		Method:     "GET",
+		Handler:    handler.JsonReturnHandler(handler.ListImages),
+		Response:   []handler.ImageList{},
+		Permission: handler.PermImagesRead,
 	},
 
 	Route{
-		Name:    "Images",
-		Pattern: "/pull/{image:[-a-zA-Z0-9.:]*(/[-a-zA-Z0-9.:]*)*}/{tag:[-a-zA-Z0-9.]*}",
-		Method:  "GET",
-		Handler: handler.JsonReturnHandler(handler.PullImage),
+		Name:       "Images",
+		Pattern:    "/pull/{image:[-a-zA-Z0-9.:]*(/[-a-zA-Z0-9.:]*)*}/{tag:[-a-zA-Z0-9.]*}",
+		Method:     "GET",
+		Handler:    handler.JsonReturnHandler(handler.PullImage),
+		Permission: handler.PermImagesWrite,
+		Action:     "image.pull",
+		Timeout:    noLimit,
 	},
 
 	Route{
-		Name:    "Images",
-		Pattern: "/push/{image:[-a-zA-Z0-9.:]*(/[-a-zA-Z0-9.:]*)*}/{tag:[-a-zA-Z0-9.]*}",
-		Method:  "GET",
-		Handler: handler.JsonReturnHandler(handler.PushImage),
+		Name:       "Images",
+		Pattern:    "/push/{image:[-a-zA-Z0-9.:]*(/[-a-zA-Z0-9.:]*)*}/{tag:[-a-zA-Z0-9.]*}",
+		Method:     "GET",
+		Handler:    handler.JsonReturnHandler(handler.PushImage),
+		Permission: handler.PermImagesWrite,
+		Action:     "image.push",
+		Timeout:    noLimit,
 	},
 
 	Route{
-		Name:    "Images",
-		Pattern: "/exists/{image:[-a-zA-Z0-9.:]*(/[-a-zA-Z0-9.:]*)*}/{tag:[-a-zA-Z0-9.]*}",
-		Method:  "GET",
-		Handler: handler.JsonReturnHandler(handler.CheckExists),
+		Name:       "Images",
+		Pattern:    "/exists/{image:[-a-zA-Z0-9.:]*(/[-a-zA-Z0-9.:]*)*}/{tag:[-a-zA-Z0-9.]*}",
+		Method:     "GET",
+		Handler:    handler.JsonReturnHandler(handler.CheckExists),
+		Response:   handler.ImageExists{},
+		Permission: handler.PermImagesRead,
 	},
 
 	Route{
-		Name:    "Images",
-		Pattern: "/download/{image:[-a-zA-Z0-9.:]*(/[-a-zA-Z0-9.:]*)*}/{tag:[-a-zA-Z0-9.]*}",
-		Method:  "GET",
-		Handler: handler.JsonReturnHandler(handler.PublicPullImage),
+		Name:       "Images",
+		Pattern:    "/download/{image:[-a-zA-Z0-9.:]*(/[-a-zA-Z0-9.:]*)*}/{tag:[-a-zA-Z0-9.]*}",
+		Method:     "GET",
+		Handler:    handler.JsonReturnHandler(handler.PublicPullImage),
+		Permission: handler.PermImagesWrite,
+		Action:     "image.download",
+		Timeout:    noLimit,
 	},
 	Route{
-		Name:    "Images",
-		Pattern: "/tag",
-		Method:  "POST",
-		Handler: handler.JsonReturnHandler(handler.TagImage),
+		Name:       "Images",
+		Pattern:    "/tag",
+		Method:     "POST",
+		Handler:    handler.JsonReturnHandler(handler.TagImage),
+		Request:    handler.TagOpt{},
+		Permission: handler.PermImagesWrite,
+		Action:     "image.tag",
 	},
 	Route{
-		Name:    "host",
-		Pattern: "/shutdown",
-		Method:  "GET",
-		Handler: http.HandlerFunc(handler.Shutdown),
+		Name:       "host",
+		Pattern:    "/shutdown",
+		Method:     "GET",
+		Handler:    handler.JsonReturnHandler(handler.Shutdown),
+		Permission: handler.PermAdmin,
+		Action:     "agent.shutdown",
+		Timeout:    noLimit,
+	},
+	Route{
+		Name:       "host",
+		Pattern:    "/shutdown",
+		Method:     "POST",
+		Handler:    handler.JsonReturnHandler(handler.Shutdown),
+		Permission: handler.PermAdmin,
+		Action:     "agent.shutdown",
+		Timeout:    noLimit,
+	},
+	Route{
+		Name:       "host",
+		Pattern:    "/drain",
+		Method:     "POST",
+		Handler:    handler.JsonReturnHandler(handler.Drain),
+		Permission: handler.PermAdmin,
+		Action:     "agent.drain",
+	},
+	Route{
+		Name:       "host",
+		Pattern:    "/undrain",
+		Method:     "POST",
+		Handler:    handler.JsonReturnHandler(handler.Undrain),
+		Permission: handler.PermAdmin,
+		Action:     "agent.undrain",
+	},
+
+	Route{
+		Name:       "host",
+		Pattern:    "/login",
+		Method:     "POST",
+		Handler:    handler.JsonReturnHandler(handler.Login),
+		Request:    handler.UserInfo{},
+		Permission: handler.PermAdmin,
+		Action:     "registry.login",
+	},
+
+	Route{
+		Name:       "host",
+		Pattern:    "/credentials",
+		Method:     "GET",
+		Handler:    handler.JsonReturnHandler(handler.ListCredentials),
+		Response:   []handler.CredentialSource{},
+		Permission: handler.PermAdmin,
 	},
 
 	Route{
-		Name:    "host",
-		Pattern: "/login",
-		Method:  "POST",
-		Handler: handler.JsonReturnHandler(handler.Login),
+		Name:       "host",
+		Pattern:    "/update",
+		Method:     "POST",
+		Handler:    handler.JsonReturnHandler(handler.UpdateAgent),
+		Request:    handler.UpdateRequest{},
+		Permission: handler.PermAdmin,
+		Action:     "agent.update",
+		Timeout:    noLimit,
+	},
+
+	Route{
+		Name:       "host",
+		Pattern:    "/registries",
+		Method:     "GET",
+		Handler:    handler.JsonReturnHandler(handler.GetRegistries),
+		Response:   handler.RegistryConfig{},
+		Permission: handler.PermAdmin,
+	},
+	Route{
+		Name:       "host",
+		Pattern:    "/registries",
+		Method:     "PUT",
+		Handler:    handler.JsonReturnHandler(handler.PutRegistries),
+		Request:    handler.RegistryConfig{},
+		Permission: handler.PermAdmin,
+		Action:     "registry.config",
+	},
+
+	Route{
+		Name:       "host",
+		Pattern:    "/audit",
+		Method:     "GET",
+		Handler:    handler.JsonReturnHandler(handler.GetAudit),
+		Response:   []handler.AuditRecord{},
+		Permission: handler.PermAdmin,
+	},
+	Route{
+		Name:       "host",
+		Pattern:    "/audit/verify",
+		Method:     "GET",
+		Handler:    handler.JsonReturnHandler(handler.VerifyAudit),
+		Response:   handler.AuditVerify{},
+		Permission: handler.PermAdmin,
+	},
+
+	Route{
+		Name:       "host",
+		Pattern:    "/policy",
+		Method:     "GET",
+		Handler:    handler.JsonReturnHandler(handler.GetPolicy),
+		Response:   handler.Policy{},
+		Permission: handler.PermAdmin,
+	},
+	Route{
+		Name:       "host",
+		Pattern:    "/policy",
+		Method:     "PUT",
+		Handler:    handler.JsonReturnHandler(handler.PutPolicy),
+		Request:    handler.Policy{},
+		Permission: handler.PermAdmin,
+		Action:     "policy.config",
+	},
+
+	Route{
+		Name:       "Runs",
+		Pattern:    "/runs",
+		Method:     "POST",
+		Handler:    handler.JsonReturnHandler(handler.CreateRun),
+		Request:    handler.RunSpec{},
+		Response:   handler.Run{},
+		Permission: handler.PermRunsWrite,
+		Action:     "run.create",
+	},
+	Route{
+		Name:       "Runs",
+		Pattern:    "/runs",
+		Method:     "GET",
+		Handler:    handler.JsonReturnHandler(handler.ListRuns),
+		Response:   []handler.Run{},
+		Permission: handler.PermRunsRead,
+	},
+	Route{
+		Name:       "Runs",
+		Pattern:    "/runs/{id}",
+		Method:     "GET",
+		Handler:    handler.JsonReturnHandler(handler.GetRun),
+		Response:   handler.Run{},
+		Permission: handler.PermRunsRead,
+	},
+	Route{
+		Name:       "Runs",
+		Pattern:    "/runs/{id}/attempts/{attempt:[0-9]+}/log",
+		Method:     "GET",
+		Handler:    handler.JsonReturnHandler(handler.GetAttemptLog),
+		Produces:   "text/plain",
+		Permission: handler.PermRunsRead,
+		Timeout:    noLimit,
+	},
+	Route{
+		Name:       "Runs",
+		Pattern:    "/runs/{id}/attempts/{attempt:[0-9]+}/artifacts/{name}",
+		Method:     "GET",
+		Handler:    handler.JsonReturnHandler(handler.GetAttemptArtifact),
+		Produces:   "application/x-tar",
+		Permission: handler.PermRunsRead,
+		Timeout:    noLimit,
+	},
+
+	Route{
+		Name:       "Queue",
+		Pattern:    "/queue",
+		Method:     "GET",
+		Handler:    handler.JsonReturnHandler(handler.GetQueue),
+		Response:   handler.QueueStatus{},
+		Permission: handler.PermRunsRead,
+	},
+	Route{
+		Name:       "Queue",
+		Pattern:    "/queue/{id}",
+		Method:     "PUT",
+		Handler:    handler.JsonReturnHandler(handler.ReprioritizeRun),
+		Request:    handler.PriorityOpt{},
+		Permission: handler.PermRunsWrite,
+		Action:     "queue.reprioritize",
+	},
+	Route{
+		Name:       "Queue",
+		Pattern:    "/queue/{id}",
+		Method:     "DELETE",
+		Handler:    handler.JsonReturnHandler(handler.DequeueRun),
+		Permission: handler.PermRunsWrite,
+		Action:     "queue.dequeue",
 	},
 }
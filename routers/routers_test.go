@@ -0,0 +1,114 @@
+package routers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"test/handler"
+)
+
+func serve(t *testing.T, method, path, body string) *httptest.ResponseRecorder {
+	handler.SetAccessKeys([]handler.AccessKey{{AccessKey: "ak", SecretKey: "sk"}})
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.SetBasicAuth("ak", "sk")
+	rr := httptest.NewRecorder()
+	NewRouter().ServeHTTP(rr, req)
+	return rr
+}
+
+// 没有输出data的接口经过中间件后也要返回Envelope
+func TestV1EnvelopeWithoutData(t *testing.T) {
+	defer serve(t, "POST", "/v1/undrain", "")
+
+	cases := []struct {
+		method, path, body string
+	}{
+		{"POST", "/v1/drain", ""},
+		{"POST", "/v1/undrain", ""},
+		{"PUT", "/v1/policy", `{}`},
+	}
+	for _, c := range cases {
+		rr := serve(t, c.method, c.path, c.body)
+		if rr.Code != http.StatusOK {
+			t.Errorf("%s %s: status %d, body %s", c.method, c.path, rr.Code, rr.Body.String())
+			continue
+		}
+		if ct := rr.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("%s %s: Content-Type %q", c.method, c.path, ct)
+		}
+		var e handler.Envelope
+		if err := json.Unmarshal(rr.Body.Bytes(), &e); err != nil {
+			t.Errorf("%s %s: body %q is not an envelope: %v", c.method, c.path, rr.Body.String(), err)
+			continue
+		}
+		if e.Error != nil || e.Meta.APIVersion != handler.APIVersion {
+			t.Errorf("%s %s: unexpected envelope %+v", c.method, c.path, e)
+		}
+		if len(e.RequestID) == 0 || e.RequestID != rr.Header().Get(handler.RequestIDHeader) {
+			t.Errorf("%s %s: request id %q, header %q", c.method, c.path, e.RequestID, rr.Header().Get(handler.RequestIDHeader))
+		}
+	}
+}
+
+func TestV1Errors(t *testing.T) {
+	cases := []struct {
+		method, path, body string
+		status             int
+	}{
+		{"GET", "/v1/runs/nope", "", http.StatusNotFound},
+		{"POST", "/v1/tag", `{"old":"a:1"}`, http.StatusUnprocessableEntity},
+		{"POST", "/v1/tag", `{"old":"` + strings.Repeat("a", handler.DefaultMaxBodySize) + `","new":"b:1"}`, http.StatusRequestEntityTooLarge},
+	}
+	for _, c := range cases {
+		rr := serve(t, c.method, c.path, c.body)
+		if rr.Code != c.status {
+			t.Errorf("%s %s: status %d, want %d", c.method, c.path, rr.Code, c.status)
+			continue
+		}
+		var e handler.Envelope
+		if err := json.Unmarshal(rr.Body.Bytes(), &e); err != nil || e.Error == nil || e.Error.Status != c.status {
+			t.Errorf("%s %s: unexpected body %s", c.method, c.path, rr.Body.String())
+		}
+	}
+}
+
+func TestRequestIDPropagated(t *testing.T) {
+	req := httptest.NewRequest("GET", "/health", nil)
+	req.Header.Set(handler.RequestIDHeader, "abc123")
+	rr := httptest.NewRecorder()
+	NewRouter().ServeHTTP(rr, req)
+	if id := rr.Header().Get(handler.RequestIDHeader); id != "abc123" {
+		t.Errorf("request id %q, want abc123", id)
+	}
+	if rr.Header().Get("Deprecation") != "true" {
+		t.Errorf("unversioned route should be marked deprecated")
+	}
+}
+
+func TestRoutePermissionRequired(t *testing.T) {
+	saved := routes
+	defer func() {
+		routes = saved
+		if recover() == nil {
+			t.Errorf("NewRouter should panic on a route without permission")
+		}
+	}()
+	routes = append(Routes{}, Route{Name: "x", Pattern: "/x", Method: "GET", Handler: http.NotFoundHandler()})
+	NewRouter()
+}
+
+func TestOpenAPIRequiresAuth(t *testing.T) {
+	for _, path := range []string{"/openapi.json", "/v1/openapi.json"} {
+		if rr := serve(t, "GET", path, ""); rr.Code != http.StatusOK {
+			t.Errorf("%s: status %d with credentials", path, rr.Code)
+		}
+		rr := httptest.NewRecorder()
+		NewRouter().ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+		if rr.Code != http.StatusUnauthorized {
+			t.Errorf("%s: status %d without credentials, want %d", path, rr.Code, http.StatusUnauthorized)
+		}
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const certCheckInterval = time.Hour
+
+// 测试服务器在注册或续期时下发的证书,PEM格式
+type CertBundle struct {
+	Cert string `json:"cert"`
+	Key  string `json:"key,omitempty"`
+	CA   string `json:"ca,omitempty"`
+}
+
+// agent自己的证书既用于监听端口,也作为访问测试服务器的客户端证书
+type CertStore struct {
+	sync.RWMutex
+	cert      *tls.Certificate
+	leaf      *x509.Certificate
+	ca        *x509.CertPool
+	transport *http.Transport
+}
+
+var Certs = new(CertStore)
+
+func serverURL(ip string, port string) string {
+	if ServerTLS {
+		return "https://" + ip + ":" + port
+	}
+	return "http://" + ip + ":" + port
+}
+
+// 启动时加载已有的证书,文件不存在时等待注册下发
+func (s *CertStore) Load() error {
+	if caContent, err := ioutil.ReadFile(TLSCAFile); err == nil {
+		if err := s.setCA(caContent); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	certContent, err := ioutil.ReadFile(TLSCertFile)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	keyContent, err := ioutil.ReadFile(TLSKeyFile)
+	if err != nil {
+		return err
+	}
+	return s.setCert(certContent, keyContent)
+}
+
+func (s *CertStore) setCA(caContent []byte) error {
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caContent) {
+		return errors.New("no certificate in CA bundle")
+	}
+	s.Lock()
+	s.ca = pool
+	s.transport = nil
+	s.Unlock()
+	return nil
+}
+
+func (s *CertStore) setCert(certContent, keyContent []byte) error {
+	cert, err := tls.X509KeyPair(certContent, keyContent)
+	if err != nil {
+		return err
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return err
+	}
+	s.Lock()
+	s.cert = &cert
+	s.leaf = leaf
+	s.Unlock()
+	log.Infof("certificate %s installed, expires at %v", leaf.Subject.CommonName, leaf.NotAfter)
+	return nil
+}
+
+// 保存并启用新证书
+func (s *CertStore) Install(bundle *CertBundle) error {
+	if len(bundle.CA) != 0 {
+		if err := s.setCA([]byte(bundle.CA)); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(TLSCAFile, []byte(bundle.CA), 0644); err != nil {
+			return err
+		}
+	}
+	if len(bundle.Cert) == 0 {
+		return nil
+	}
+	if len(bundle.Key) == 0 {
+		return errors.New("certificate without key")
+	}
+	if err := s.setCert([]byte(bundle.Cert), []byte(bundle.Key)); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(TLSKeyFile, []byte(bundle.Key), 0600); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(TLSCertFile, []byte(bundle.Cert), 0644)
+}
+
+func (s *CertStore) HasCA() bool {
+	s.RLock()
+	defer s.RUnlock()
+	return s.ca != nil
+}
+
+func (s *CertStore) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.RLock()
+	defer s.RUnlock()
+	if s.cert == nil {
+		return nil, errors.New("no certificate yet")
+	}
+	return s.cert, nil
+}
+
+func (s *CertStore) getClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	s.RLock()
+	defer s.RUnlock()
+	if s.cert == nil {
+		return &tls.Certificate{}, nil
+	}
+	return s.cert, nil
+}
+
+// 监听端口使用的TLS配置,开启MutualTLS时校验客户端证书
+func (s *CertStore) ServerConfig() *tls.Config {
+	cfg := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: s.getCertificate,
+	}
+	if MutualTLS {
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+		cfg.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			s.RLock()
+			ca := s.ca
+			s.RUnlock()
+			if ca == nil {
+				return nil, errors.New("no CA to verify client certificates")
+			}
+			c := cfg.Clone()
+			c.GetConfigForClient = nil
+			c.ClientCAs = ca
+			return c, nil
+		}
+	}
+	return cfg
+}
+
+// 访问测试服务器使用的transport,CA变化后重建
+func (s *CertStore) Transport() http.RoundTripper {
+	if !ServerTLS {
+		return nil
+	}
+	s.Lock()
+	defer s.Unlock()
+	if s.transport == nil {
+		s.transport = &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{
+				MinVersion:           tls.VersionTLS12,
+				RootCAs:              s.ca,
+				GetClientCertificate: s.getClientCertificate,
+			},
+		}
+	}
+	return s.transport
+}
+
+// 剩余有效期不足1/3时续期
+func (s *CertStore) needRenew(now time.Time) bool {
+	s.RLock()
+	defer s.RUnlock()
+	if s.leaf == nil {
+		return false
+	}
+	lifetime := s.leaf.NotAfter.Sub(s.leaf.NotBefore)
+	return s.leaf.NotAfter.Sub(now) < lifetime/3
+}
+
+// 本地生成新的私钥,把CSR发给测试服务器签发
+func (s *CertStore) Renew() error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: Identity.ID()},
+	}, key)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(map[string]string{
+		"csr": string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr})),
+	})
+	if err != nil {
+		return err
+	}
+
+	client := new(BaseClient)
+	client.Opts = new(ClientOpts)
+	client.Opts.Url = serverURL(ServerIP, ServerPort)
+	client.Opts.Timeout = time.Duration(10 * time.Second)
+	client.Opts.Identity = Identity
+	client.Opts.Transport = s.Transport()
+
+	resp, err := client.DoPost("/certificates", data)
+
+	defer func() {
+		if resp != nil {
+			resp.Body.Close()
+		}
+	}()
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("renew certificate fail: %s", resp.Status)
+	}
+
+	bundle := new(CertBundle)
+	if err := json.NewDecoder(resp.Body).Decode(bundle); err != nil {
+		return err
+	}
+	bundle.Key = string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}))
+	return s.Install(bundle)
+}
+
+func (s *CertStore) KeepFresh() {
+	for {
+		if s.needRenew(time.Now()) {
+			if err := s.Renew(); err != nil {
+				log.Errorf("renew certificate fail:%v", err)
+			}
+		}
+		time.Sleep(certCheckInterval)
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"test/handler"
+)
+
+const (
+	tunnelPollWait   = 30 * time.Second
+	tunnelMaxBackoff = 30 * time.Second
+)
+
+// 反向连接模式:agent主动连接测试服务器,通过长轮询取得请求,
+// 交给本地router处理后再把结果回传,不需要开放监听端口
+type TunnelRequest struct {
+	ID     string      `json:"id"`
+	Method string      `json:"method"`
+	Path   string      `json:"path"`
+	Header http.Header `json:"header"`
+	Body   []byte      `json:"body"`
+}
+
+type TunnelResponse struct {
+	ID     string      `json:"id"`
+	Status int         `json:"status"`
+	Header http.Header `json:"header"`
+	Body   []byte      `json:"body"`
+}
+
+// 缓存handler的输出,请求处理完后整体回传
+type bufferedResponse struct {
+	status int
+	header http.Header
+	body   bytes.Buffer
+}
+
+func (b *bufferedResponse) Header() http.Header {
+	return b.header
+}
+
+func (b *bufferedResponse) Write(p []byte) (int, error) {
+	if b.status == 0 {
+		b.status = http.StatusOK
+	}
+	return b.body.Write(p)
+}
+
+func (b *bufferedResponse) WriteHeader(status int) {
+	if b.status == 0 {
+		b.status = status
+	}
+}
+
+type Tunnel struct {
+	client  *BaseClient
+	handler http.Handler
+	prefix  string
+}
+
+func NewTunnel(ip string, port string, handler http.Handler) *Tunnel {
+	client := new(BaseClient)
+	client.Opts = new(ClientOpts)
+	client.Opts.Url = serverURL(ip, port)
+	client.Opts.Timeout = tunnelPollWait + 10*time.Second
+	client.Opts.Identity = Identity
+	client.Opts.Transport = Certs.Transport()
+
+	return &Tunnel{
+		client:  client,
+		handler: handler,
+		prefix:  "/tunnel/" + Identity.ID(),
+	}
+}
+
+func (t *Tunnel) poll() ([]TunnelRequest, error) {
+	resp, err := t.client.DoAction(t.prefix+"/poll?wait="+strconv.Itoa(int(tunnelPollWait/time.Second)), Get)
+
+	defer func() {
+		if resp != nil {
+			resp.Body.Close()
+		}
+	}()
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusNoContent:
+		return nil, nil
+	case http.StatusOK:
+	default:
+		return nil, fmt.Errorf("tunnel poll fail: %s", resp.Status)
+	}
+
+	var reqs []TunnelRequest
+	if err := json.NewDecoder(resp.Body).Decode(&reqs); err != nil {
+		return nil, err
+	}
+	return reqs, nil
+}
+
+func (t *Tunnel) serve(treq TunnelRequest) {
+	req, err := http.NewRequest(treq.Method, treq.Path, bytes.NewReader(treq.Body))
+	bw := &bufferedResponse{header: make(http.Header)}
+	if err != nil {
+		bw.WriteHeader(http.StatusBadRequest)
+		bw.Write([]byte(err.Error()))
+	} else {
+		for k, v := range treq.Header {
+			req.Header[k] = v
+		}
+		req.RemoteAddr = ServerIP + ":" + ServerPort
+		req.RequestURI = treq.Path
+		handler.SetTunneled(req)
+		t.handler.ServeHTTP(bw, req)
+	}
+	if bw.status == 0 {
+		bw.status = http.StatusOK
+	}
+
+	data, err := json.Marshal(TunnelResponse{
+		ID:     treq.ID,
+		Status: bw.status,
+		Header: bw.header,
+		Body:   bw.body.Bytes(),
+	})
+	if err != nil {
+		log.Errorf("tunnel: encode response of %s fail:%v", treq.ID, err)
+		return
+	}
+	resp, err := t.client.DoPost(t.prefix+"/responses", data)
+	if resp != nil {
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	if err != nil {
+		log.Errorf("tunnel: send response of %s fail:%v", treq.ID, err)
+		return
+	}
+	log.Debugf("tunnel: %s %s => %d", treq.Method, treq.Path, bw.status)
+}
+
+func (t *Tunnel) Run() {
+	failures := 0
+	for {
+		reqs, err := t.poll()
+		if err != nil {
+			failures++
+			wait := time.Duration(failures) * time.Second
+			if wait > tunnelMaxBackoff {
+				wait = tunnelMaxBackoff
+			}
+			log.Errorf("tunnel: %v, retry in %v", err, wait)
+			time.Sleep(wait)
+			continue
+		}
+		failures = 0
+
+		//拉取/推送镜像耗时较长,每个请求单独处理
+		for _, req := range reqs {
+			go t.serve(req)
+		}
+	}
+}
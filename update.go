@@ -0,0 +1,274 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"test/errjson"
+	"test/handler"
+)
+
+// 编译时通过 -ldflags "-X main.Version=..." 设置
+var Version = "dev"
+
+// 升级后新程序还没通过第一次心跳时,记录回滚需要的信息
+type UpdateMarker struct {
+	Version         string `json:"version"`
+	PreviousVersion string `json:"previous_version"`
+	Previous        string `json:"previous"`
+	Boots           int    `json:"boots"`
+}
+
+// 升级后在这段时间内没有一次注册/心跳成功才回滚,网络抖动不算失败
+const updateConfirmWindow = 10 * time.Minute
+
+var (
+	pendingUpdate *UpdateMarker
+	pendingSince  time.Time
+)
+
+// 测试服务器明确拒绝了新程序(注册返回4xx,或者下发的配置无法应用),不需要再等
+type rejectedError struct {
+	error
+}
+
+func updateMarkerPath() string {
+	return StateFile + ".update"
+}
+
+func saveMarker(marker *UpdateMarker) error {
+	byteContent, err := json.Marshal(marker)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(updateMarkerPath(), byteContent, 0600)
+}
+
+func executable() (string, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	return filepath.EvalSymlinks(exe)
+}
+
+func verifySignature(data []byte, signature string) error {
+	if len(UpdateKeyFile) == 0 {
+		return nil
+	}
+	if len(signature) == 0 {
+		return errors.New("signature is required")
+	}
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return fmt.Errorf("invalid signature: %v", err)
+	}
+
+	keyContent, err := ioutil.ReadFile(UpdateKeyFile)
+	if err != nil {
+		return err
+	}
+	block, _ := pem.Decode(keyContent)
+	if block == nil {
+		return fmt.Errorf("no PEM data in %s", UpdateKeyFile)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return err
+	}
+
+	digest := sha256.Sum256(data)
+	switch pub := key.(type) {
+	case ed25519.PublicKey:
+		if !ed25519.Verify(pub, data, sig) {
+			return errors.New("signature mismatch")
+		}
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(pub, digest[:], sig) {
+			return errors.New("signature mismatch")
+		}
+	case *rsa.PublicKey:
+		if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig); err != nil {
+			return errors.New("signature mismatch")
+		}
+	default:
+		return fmt.Errorf("unsupported key type %T", key)
+	}
+	return nil
+}
+
+// 下载新程序并校验,返回安装函数
+func prepareUpdate(req handler.UpdateRequest) (func() error, error) {
+	exe, err := executable()
+	if err != nil {
+		return nil, err
+	}
+
+	client := new(BaseClient)
+	client.Opts = new(ClientOpts)
+	client.Opts.Url = serverURL(ServerIP, ServerPort)
+	client.Opts.Timeout = time.Duration(5 * time.Minute)
+	client.Opts.Identity = Identity
+	client.Opts.Transport = Certs.Transport()
+
+	resp, err := client.DoAction(req.URL, Get)
+
+	defer func() {
+		if resp != nil {
+			resp.Body.Close()
+		}
+	}()
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("download %s fail: %s", req.URL, resp.Status)
+	}
+
+	newPath := exe + ".new"
+	fp, err := os.OpenFile(newPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0755)
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(fp, h), resp.Body)
+	fp.Close()
+	if err != nil {
+		os.Remove(newPath)
+		return nil, err
+	}
+
+	if sum := hex.EncodeToString(h.Sum(nil)); !strings.EqualFold(sum, req.SHA256) {
+		os.Remove(newPath)
+		return nil, errjson.NewNotValidEntityError(fmt.Sprintf("checksum mismatch: expect %s, got %s", req.SHA256, sum))
+	}
+	if len(UpdateKeyFile) != 0 {
+		data, err := ioutil.ReadFile(newPath)
+		if err == nil {
+			err = verifySignature(data, req.Signature)
+		}
+		if err != nil {
+			os.Remove(newPath)
+			return nil, errjson.NewNotValidEntityError(err.Error())
+		}
+	}
+	log.Infof("update %s downloaded to %s", req.Version, newPath)
+
+	return func() error {
+		return installUpdate(exe, newPath, req.Version)
+	}, nil
+}
+
+func installUpdate(exe string, newPath string, version string) error {
+	prev := exe + ".prev"
+	marker := &UpdateMarker{
+		Version:         version,
+		PreviousVersion: Version,
+		Previous:        prev,
+	}
+	if err := saveMarker(marker); err != nil {
+		return err
+	}
+	if err := os.Rename(exe, prev); err != nil {
+		os.Remove(updateMarkerPath())
+		return err
+	}
+	if err := os.Rename(newPath, exe); err != nil {
+		os.Rename(prev, exe)
+		os.Remove(updateMarkerPath())
+		return err
+	}
+
+	log.Infof("update %s => %s, re-exec %s", Version, version, exe)
+	return syscall.Exec(exe, os.Args, os.Environ())
+}
+
+func rollback(marker *UpdateMarker, reason string) {
+	log.Errorf("update to %s failed (%s), roll back to %s", marker.Version, reason, marker.PreviousVersion)
+	defer os.Remove(updateMarkerPath())
+
+	exe, err := executable()
+	if err != nil {
+		log.Errorf("rollback fail:%v", err)
+		return
+	}
+	if err := os.Rename(exe, exe+".failed"); err != nil {
+		log.Errorf("rollback fail:%v", err)
+		return
+	}
+	if err := os.Rename(marker.Previous, exe); err != nil {
+		log.Errorf("rollback fail:%v", err)
+		os.Rename(exe+".failed", exe)
+		return
+	}
+	os.Remove(updateMarkerPath())
+	if err := syscall.Exec(exe, os.Args, os.Environ()); err != nil {
+		log.Errorf("rollback exec fail:%v", err)
+	}
+}
+
+// 启动时检查是否刚升级过;新程序在确认之前又重启了,说明它起不来,直接回滚
+func checkUpdate() {
+	byteContent, err := ioutil.ReadFile(updateMarkerPath())
+	if err != nil {
+		return
+	}
+	marker := new(UpdateMarker)
+	if err := json.Unmarshal(byteContent, marker); err != nil {
+		log.Errorf("invalid update marker:%v", err)
+		os.Remove(updateMarkerPath())
+		return
+	}
+
+	marker.Boots++
+	if marker.Boots > 1 {
+		rollback(marker, "restarted before the first heartbeat")
+		return
+	}
+	if err := saveMarker(marker); err != nil {
+		log.Errorf("save update marker fail:%v", err)
+	}
+	pendingUpdate = marker
+	pendingSince = time.Now()
+}
+
+// 升级后第一次注册/心跳成功就确认;被服务器拒绝,或者超过updateConfirmWindow一直失败才回滚
+func confirmUpdate(err error) {
+	if pendingUpdate == nil {
+		return
+	}
+	if err != nil {
+		_, rejected := err.(rejectedError)
+		if !rejected && time.Since(pendingSince) < updateConfirmWindow {
+			log.Warnf("update %s not confirmed yet: %v", pendingUpdate.Version, err)
+			return
+		}
+	}
+	marker := pendingUpdate
+	pendingUpdate = nil
+
+	if err != nil {
+		rollback(marker, err.Error())
+		return
+	}
+	os.Remove(updateMarkerPath())
+	log.Infof("update %s => %s confirmed", marker.PreviousVersion, marker.Version)
+}